@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
+	"github.com/hashicorp/hcl/hcl/token"
+	"github.com/hashicorp/vault/api"
+	"github.com/jmanero/vault-yubikey-helper/cmd/util"
+	"github.com/jmanero/vault-yubikey-helper/pkg/common"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+// ErrDiscovery is returned if cluster nodes can not be discovered from the Raft configuration
+var ErrDiscovery = errors.New("Unable to discover Raft peers")
+
+// NodeResult reports the outcome of unsealing a single cluster node
+type NodeResult struct {
+	Address  string
+	Sealed   bool
+	Progress int
+	T        int
+	Err      error
+}
+
+func (result NodeResult) String() string {
+	switch {
+	case result.Err != nil:
+		return fmt.Sprintf("%s: error: %s", result.Address, result.Err)
+	case result.Sealed:
+		return fmt.Sprintf("%s: sealed (progress %d of %d)", result.Address, result.Progress, result.T)
+	default:
+		return fmt.Sprintf("%s: unsealed", result.Address)
+	}
+}
+
+// raftConfiguration is the subset of sys/storage/raft/configuration used to discover cluster nodes
+type raftConfiguration struct {
+	Servers []struct {
+		NodeID  string `json:"node_id"`
+		Address string `json:"address"`
+	} `json:"servers"`
+}
+
+// unsealCluster decrypts unseal-keys once, and uses them to unseal each node of a cluster concurrently
+func unsealCluster(cmd *cobra.Command, args []string) (err error) {
+	vault, err := api.NewClient(&util.Vault)
+	if err != nil {
+		return
+	}
+
+	message, err := util.ReadSecrets(args)
+	if err != nil {
+		return util.CardExit(err)
+	}
+
+	nodes := UnsealNodes
+	if len(nodes) == 0 {
+		// Discovery requires the --vault-endpoint node to be unsealed
+		result := unsealNode(cmd.Context(), vault, message.Keys)
+		if result.Err != nil {
+			return util.Exit{Code: util.ExitVaultUnreachable, Err: fmt.Errorf("%w: unable to unseal %s: %w", ErrDiscovery, result.Address, result.Err)}
+		}
+
+		if result.Sealed {
+			return util.Exit{Code: util.ExitSealed, Err: fmt.Errorf("%w: %s is still sealed (progress %d of %d). Use --node to list cluster nodes", ErrDiscovery, result.Address, result.Progress, result.T)}
+		}
+
+		common.Logger.Info("Unsealed discovery node", zap.Stringer("result", result))
+
+		nodes, err = discoverNodes(cmd.Context(), vault, message.RootToken)
+		if err != nil {
+			// Without an active leader, e.g. after a whole-cluster outage, use the peers of Vault's own configuration
+			common.Logger.Warn("Unable to discover raft peers. Reading retry_join peers from Vault's configuration", zap.String("path", UnsealVaultConfig), zap.Error(err))
+
+			var err1 error
+			nodes, err1 = configNodes(UnsealVaultConfig)
+			if err1 != nil {
+				return fmt.Errorf("%w. List cluster nodes with --node: %w", err, err1)
+			}
+
+			// retry_join lists the other peers of the --vault-endpoint node
+			nodes = append([]string{util.Vault.Address}, nodes...)
+		}
+	}
+
+	clients := make([]*api.Client, len(nodes))
+	for i, address := range nodes {
+		clients[i], err = vault.Clone()
+		if err != nil {
+			return
+		}
+
+		err = clients[i].SetAddress(address)
+		if err != nil {
+			return
+		}
+	}
+
+	results := make([]NodeResult, len(nodes))
+
+	var wg sync.WaitGroup
+	for i, client := range clients {
+		wg.Add(1)
+
+		go func(i int, client *api.Client) {
+			defer wg.Done()
+			results[i] = unsealNode(cmd.Context(), client, message.Keys)
+		}(i, client)
+	}
+
+	wg.Wait()
+
+	failed := 0
+	for _, result := range results {
+		cmd.Println(result)
+
+		if result.Err != nil || result.Sealed {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return util.Exit{Code: util.ExitSealed, Err: fmt.Errorf("%w: %d of %d cluster nodes", ErrSealed, failed, len(results))}
+	}
+
+	return
+}
+
+// unsealNode submits keys to a sealed node until it is unsealed
+func unsealNode(ctx context.Context, vault *api.Client, keys []string) (result NodeResult) {
+	result.Address = vault.Address()
+
+	status, err := vault.Sys().SealStatusWithContext(ctx)
+	if err != nil {
+		result.Err = err
+		return
+	}
+
+	for _, key := range keys {
+		if !status.Sealed {
+			break
+		}
+
+		common.Logger.Info("Unsealing cluster node", zap.String("endpoint", result.Address))
+		status, err = vault.Sys().UnsealWithContext(ctx, key)
+		if err != nil {
+			result.Err = err
+			return
+		}
+	}
+
+	result.Sealed, result.Progress, result.T = status.Sealed, status.Progress, status.T
+	common.Logger.Info("Cluster node seal status", zap.String("endpoint", result.Address), zap.Bool("sealed", result.Sealed))
+	return
+}
+
+// configNodes lists the leader_api_addr of each retry_join stanza of a raft storage stanza in a Vault configuration file
+func configNodes(name string) (nodes []string, err error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return
+	}
+
+	config, err := hcl.ParseBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	root, is := config.Node.(*ast.ObjectList)
+	if !is {
+		return nil, fmt.Errorf("%w: %s has no raft storage stanza", ErrDiscovery, name)
+	}
+
+	for _, storage := range root.Filter("storage", "raft").Items {
+		body, is := storage.Val.(*ast.ObjectType)
+		if !is {
+			continue
+		}
+
+		for _, join := range body.List.Filter("retry_join").Items {
+			stanza, is := join.Val.(*ast.ObjectType)
+			if !is {
+				continue
+			}
+
+			for _, item := range stanza.List.Filter("leader_api_addr").Items {
+				if value, is := item.Val.(*ast.LiteralType); is && value.Token.Type == token.STRING {
+					address, _ := value.Token.Value().(string)
+
+					common.Logger.Info("Read raft peer from configuration", zap.String("path", name), zap.String("endpoint", address))
+					nodes = append(nodes, address)
+				}
+			}
+		}
+	}
+
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("%w: %s has no raft retry_join stanzas with a leader_api_addr", ErrDiscovery, name)
+	}
+
+	return
+}
+
+// discoverNodes lists the API addresses of Raft cluster members. Raft records each member's cluster
+// address, so API addresses use the host of the cluster address with the scheme and port of --vault-endpoint
+func discoverNodes(ctx context.Context, vault *api.Client, token string) (nodes []string, err error) {
+	if len(token) == 0 {
+		return nil, fmt.Errorf("%w: Raft peer discovery requires a root token. Use --node to list cluster nodes", util.ErrNoRootToken)
+	}
+
+	client, err := vault.Clone()
+	if err != nil {
+		return
+	}
+
+	client.SetToken(token)
+
+	common.Logger.Info("Reading raft configuration", zap.String("endpoint", util.Vault.Address))
+	secret, err := client.Logical().ReadWithContext(ctx, "sys/storage/raft/configuration")
+	if err != nil {
+		return nil, fmt.Errorf("%w: the cluster may not have an active leader. Use --node to list cluster nodes: %w", ErrDiscovery, err)
+	}
+
+	if secret == nil {
+		return nil, fmt.Errorf("%w: empty response from %s", ErrDiscovery, util.Vault.Address)
+	}
+
+	data, err := json.Marshal(secret.Data["config"])
+	if err != nil {
+		return
+	}
+
+	var config raftConfiguration
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return
+	}
+
+	endpoint, err := url.Parse(util.Vault.Address)
+	if err != nil {
+		return
+	}
+
+	for _, server := range config.Servers {
+		host, _, err1 := net.SplitHostPort(server.Address)
+		if err1 != nil {
+			return nil, fmt.Errorf("%w: invalid cluster address for node %s: %w", ErrDiscovery, server.NodeID, err1)
+		}
+
+		address := *endpoint
+		address.Host = host
+
+		if port := endpoint.Port(); len(port) > 0 {
+			address.Host = net.JoinHostPort(host, port)
+		}
+
+		common.Logger.Info("Discovered raft node", zap.String("node_id", server.NodeID), zap.String("cluster_address", server.Address), zap.String("endpoint", address.String()))
+		nodes = append(nodes, address.String())
+	}
+
+	return
+}
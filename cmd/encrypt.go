@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/jmanero/vault-yubikey-helper/cmd/util"
+	"github.com/jmanero/vault-yubikey-helper/pkg/common"
+	"github.com/jmanero/vault-yubikey-helper/pkg/envelope"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var encrypt = cobra.Command{
+	Use:   "encrypt IN OUT",
+	Short: "Encrypt an arbitrary file for PIV devices and --to-recipient keys. Use - to read from STDIN",
+	RunE:  Encrypt,
+	Args:  cobra.ExactArgs(2),
+}
+
+var decrypt = cobra.Command{
+	Use:    "decrypt IN [OUT]",
+	Short:  "Decrypt a file encrypted by the encrypt command to STDOUT or file. Use - to read from STDIN",
+	PreRun: util.PinFromEnvironment,
+	RunE:   Decrypt,
+	Args:   cobra.RangeArgs(1, 2),
+
+	Long: `Decrypt a file encrypted by the encrypt command to STDOUT or file.
+
+Log messages are written to STDERR, so that STDOUT holds only the decrypted
+content when OUT is not given.`,
+}
+
+func init() {
+	flags := encrypt.PersistentFlags()
+	util.RecipientFlags(flags)
+
+	CLI.AddCommand(&encrypt)
+	CLI.AddCommand(&decrypt)
+}
+
+// readInput reads a file, or STDIN for the name -
+func readInput(cmd *cobra.Command, name string) ([]byte, error) {
+	if name == "-" {
+		return io.ReadAll(cmd.InOrStdin())
+	}
+
+	common.Logger.Info("Reading file", zap.String("path", name))
+	return os.ReadFile(name)
+}
+
+// Encrypt the raw content of a file
+func Encrypt(cmd *cobra.Command, args []string) (err error) {
+	data, err := readInput(cmd, args[0])
+	if err != nil {
+		return
+	}
+
+	recipients, err := util.Recipients()
+	if err != nil {
+		return
+	}
+
+	encrypted, err := util.Seal(data, recipients)
+	if err != nil {
+		return
+	}
+
+	common.Logger.Info("Writing encrypted file", zap.String("path", args[1]))
+	return common.WriteAtomic(args[1], encrypted, 0600)
+}
+
+// Decrypt the raw content of an encrypted file
+func Decrypt(cmd *cobra.Command, args []string) (err error) {
+	encrypted, err := readInput(cmd, args[0])
+	if err != nil {
+		return
+	}
+
+	identities, err := util.Identities()
+	if err != nil {
+		return
+	}
+
+	data, _, err := envelope.Open(encrypted, identities...)
+	if err != nil {
+		return
+	}
+
+	if len(args) > 1 {
+		common.Logger.Info("Writing decrypted file", zap.String("path", args[1]))
+		return common.WriteAtomic(args[1], data, 0600)
+	}
+
+	_, err = cmd.OutOrStdout().Write(data)
+	return
+}
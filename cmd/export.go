@@ -0,0 +1,65 @@
+package main
+
+import (
+	"github.com/jmanero/vault-yubikey-helper/cmd/util"
+	"github.com/jmanero/vault-yubikey-helper/pkg/common"
+	"github.com/jmanero/vault-yubikey-helper/pkg/envelope"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var export = cobra.Command{
+	Use:   "export-recipient [FILE]",
+	Short: "Export the public-key of a Yubikey's key-management slot to STDOUT or file, for use with --to-recipient",
+	RunE:  Export,
+	Args:  cobra.MaximumNArgs(1),
+
+	Long: `Export the public-key of a Yubikey's key-management slot to STDOUT or file.
+
+The exported file can be used with the --to-recipient flag of init and share
+to encrypt secrets for the Yubikey on a host that it is not attached to. The
+Yubikey's serial number is recorded on a line before the PEM block, where
+OpenSSL ignores it, and is copied into envelopes encrypted for the file.
+
+Log messages are written to STDERR, so that STDOUT holds only the PEM block
+when FILE is not given.`,
+}
+
+// Export options
+var (
+	ExportCertificate bool
+)
+
+func init() {
+	flags := export.PersistentFlags()
+	flags.BoolVar(&ExportCertificate, "certificate", false, "Export the slot's certificate instead of its public-key")
+
+	CLI.AddCommand(&export)
+}
+
+// Export writes the PEM encoded public-key or certificate of a Yubikey's key-management slot
+func Export(cmd *cobra.Command, args []string) (err error) {
+	recipient, cert, err := envelope.PIVCertificate(util.Yubikey)
+	if err != nil {
+		return
+	}
+
+	if !ExportCertificate {
+		cert = nil
+	} else if cert == nil {
+		common.Logger.Warn("Key-management slot has no certificate, exporting public-key", zap.Uint32("serial", recipient.Device))
+	}
+
+	data, err := envelope.EncodeRecipient(recipient, cert)
+	if err != nil {
+		return
+	}
+
+	if len(args) > 0 {
+		common.Logger.Info("Writing recipient to file", zap.String("path", args[0]), zap.Uint32("serial", recipient.Device), zap.String("key_id", common.FingerprintSPKI(recipient.PublicKey)))
+		return common.WriteAtomic(args[0], data, 0644)
+	}
+
+	_, err = cmd.OutOrStdout().Write(data)
+	return
+}
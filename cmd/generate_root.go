@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/jmanero/vault-yubikey-helper/cmd/util"
+	"github.com/jmanero/vault-yubikey-helper/pkg/common"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var generateRoot = cobra.Command{
+	Use:    "generate-root FILE...",
+	Short:  "Generate a new root token with decrypted unseal-keys, and print it or use it to login",
+	PreRun: util.PinFromEnvironment,
+	RunE:   GenerateRoot,
+	Args:   cobra.MinimumNArgs(1),
+
+	Long: `Generate a new root token with decrypted unseal-keys, and print it or use it to login.
+
+Unseal-keys are decrypted from each FILE that can be decrypted with an attached
+PIV device, and submitted to Vault's generate-root endpoint with a one-time
+password until a new root token is generated. If Vault uses an auto-unseal seal,
+recovery keys are submitted instead.
+
+With --login, the new root token is used to request a token like the login
+command, and is revoked afterwards instead of being printed. Otherwise the root
+token is the only output on STDOUT, as log messages are written to STDERR.`,
+}
+
+// Errors
+var (
+	ErrGenerateRootStarted    = errors.New("A root token generation attempt is already in progress")
+	ErrGenerateRootIncomplete = errors.New("Root token generation did not complete")
+	ErrOTP                    = errors.New("Invalid one-time password")
+)
+
+// Generate root options
+var (
+	GenerateLogin  bool
+	GenerateCancel bool
+)
+
+func init() {
+	flags := generateRoot.PersistentFlags()
+	flags.BoolVar(&GenerateLogin, "login", false, "Use the new root token to request a token like the login command, then revoke it")
+	flags.BoolVar(&GenerateCancel, "cancel", false, "Cancel a root token generation attempt that is already in progress")
+	TokenFlags(flags)
+
+	CLI.AddCommand(&generateRoot)
+}
+
+// GenerateRoot drives Vault's generate-root flow with decrypted unseal-keys
+func GenerateRoot(cmd *cobra.Command, args []string) (err error) {
+	vault, err := api.NewClient(&util.Vault)
+	if err != nil {
+		return
+	}
+
+	message, err := util.ReadSecrets(args)
+	if err != nil {
+		return
+	}
+
+	status, err := vault.Sys().SealStatusWithContext(cmd.Context())
+	if err != nil {
+		return
+	}
+
+	keys, err := util.OperationKeys(message, status)
+	if err != nil {
+		return
+	}
+
+	token, err := generateRootToken(cmd.Context(), vault, keys)
+	if err != nil {
+		return
+	}
+
+	if !GenerateLogin {
+		_, err = fmt.Fprintln(cmd.OutOrStdout(), token)
+		return
+	}
+
+	vault.SetToken(token)
+	err = RequestToken(cmd.Context(), vault)
+
+	common.Logger.Info("Revoking generated root token")
+	if err1 := vault.Auth().Token().RevokeSelfWithContext(cmd.Context(), ""); err1 != nil {
+		common.Logger.Error("Unable to revoke generated root token", zap.Error(err1))
+		if err == nil {
+			err = err1
+		}
+	}
+
+	return
+}
+
+// generateRootToken submits keys to a new generate-root attempt with a server-generated one-time password, and decodes the new root token
+func generateRootToken(ctx context.Context, vault *api.Client, keys []string) (token string, err error) {
+	status, err := vault.Sys().GenerateRootStatusWithContext(ctx)
+	if err != nil {
+		return
+	}
+
+	if status.Started {
+		if !GenerateCancel {
+			return "", fmt.Errorf("%w: progress %d of %d. Use --cancel to restart it", ErrGenerateRootStarted, status.Progress, status.Required)
+		}
+
+		common.Logger.Warn("Canceling root token generation attempt", zap.Int("progress", status.Progress), zap.Int("required", status.Required))
+		err = vault.Sys().GenerateRootCancelWithContext(ctx)
+		if err != nil {
+			return
+		}
+	}
+
+	common.Logger.Info("Starting root token generation", zap.String("endpoint", util.Vault.Address))
+	status, err = vault.Sys().GenerateRootInitWithContext(ctx, "", "")
+	if err != nil {
+		return
+	}
+
+	otp, nonce := status.OTP, status.Nonce
+	if len(otp) == 0 {
+		return "", fmt.Errorf("%w: Vault did not generate a one-time password. Vault 1.10 or later is required", ErrOTP)
+	}
+
+	// Don't leave an incomplete attempt behind
+	defer func() {
+		if err != nil {
+			common.Logger.Warn("Canceling incomplete root token generation attempt")
+			vault.Sys().GenerateRootCancelWithContext(ctx)
+		}
+	}()
+
+	for _, key := range keys {
+		common.Logger.Info("Submitting key for root token generation", zap.Int("progress", status.Progress), zap.Int("required", status.Required))
+		status, err = vault.Sys().GenerateRootUpdateWithContext(ctx, key, nonce)
+		if err != nil {
+			return
+		}
+
+		if status.Complete {
+			break
+		}
+	}
+
+	if !status.Complete {
+		return "", fmt.Errorf("%w: progress %d of %d", ErrGenerateRootIncomplete, status.Progress, status.Required)
+	}
+
+	common.Logger.Info("Root token generation complete")
+	return DecodeRootToken(status.EncodedToken, otp)
+}
+
+// DecodeRootToken recovers a root token from the encoded token of a completed generate-root attempt and its one-time password
+func DecodeRootToken(encoded, otp string) (_ string, err error) {
+	token, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil {
+		return
+	}
+
+	if len(token) != len(otp) {
+		return "", fmt.Errorf("%w: length %d does not match encoded token length %d", ErrOTP, len(otp), len(token))
+	}
+
+	for i := range token {
+		token[i] ^= otp[i]
+	}
+
+	return string(token), nil
+}
@@ -1,45 +1,351 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
 	"github.com/hashicorp/vault/api"
 	"github.com/jmanero/vault-yubikey-helper/cmd/util"
 	"github.com/jmanero/vault-yubikey-helper/pkg/common"
 	"github.com/jmanero/vault-yubikey-helper/pkg/envelope"
+	"github.com/jmanero/vault-yubikey-helper/pkg/piv"
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
 )
 
+var initialize = cobra.Command{
+	Use:   "init FILE",
+	Short: "Initialize a new vault, encrypt its unseal-key and root token, and write encrypted message to the specified file",
+	RunE:  Initialize,
+	Args:  cobra.ExactArgs(1),
+
+	Long: `Initialize a new vault, encrypt its unseal-key and root token, and write
+encrypted message to the specified file.
+
+With --shares greater than 1, each unseal-key share is encrypted for a different
+PIV device or --to-recipient key and written to its own file, numbered from 1 before the extension of
+FILE (e.g. seal.json becomes seal.1.json, seal.2.json, ...)
+
+With --split, the root token is omitted from unseal-key files, and written to
+its own file for --root-serial PIV devices, with "root" before the extension of
+FILE (e.g. seal.root.json).
+
+With --revoke-root, the root token is not encrypted. Instead, the vault is
+unsealed and its initial root token is revoked once the vault is active, waiting
+up to --revoke-wait. init fails if the token can not be revoked. Use generate-root
+to create a new root token from the unseal-keys when one is needed.
+
+With --pgp-key, an OpenPGP encrypted copy of each file's secrets is written
+beside it with an .asc extension, and can be decrypted with gpg.
+
+If Vault uses an auto-unseal seal, it is initialized with --recovery-shares and
+--recovery-threshold instead, and recovery keys are encrypted in place of
+unseal-keys, one share per file like --shares.`,
+}
+
+// Init options
+var (
+	SecretShares    int
+	SecretThreshold int
+	InitSplit       bool
+	RootSerials     []uint
+	RevokeRoot      bool
+	RevokeWait      time.Duration
+
+	RecoveryShares    int
+	RecoveryThreshold int
+)
+
 func init() {
-	CLI.AddCommand(&cobra.Command{
-		Use:   "init FILE",
-		Short: "Initialize a new vault, encrypt its unseal-key and root token, and write encrypted message to the specified file",
-		RunE:  Initialize,
-		Args:  cobra.ExactArgs(1),
-	})
+	flags := initialize.PersistentFlags()
+	util.RecipientFlags(flags)
+	util.EscrowFlags(flags)
+	flags.IntVar(&SecretShares, "shares", 1, "Number of unseal-key shares to generate, each encrypted for a different PIV device or --to-recipient key")
+	flags.IntVar(&SecretThreshold, "threshold", 1, "Number of unseal-key shares required to unseal the vault")
+	flags.IntVar(&RecoveryShares, "recovery-shares", 1, "Number of recovery key shares to generate if Vault uses an auto-unseal seal, each encrypted for a different PIV device or --to-recipient key")
+	flags.IntVar(&RecoveryThreshold, "recovery-threshold", 1, "Number of recovery key shares required for operations like generate-root and rekey if Vault uses an auto-unseal seal")
+	flags.BoolVar(&InitSplit, "split", false, "Write the root token to a separate file for different PIV devices, and omit it from unseal-key files")
+	flags.BoolVar(&RevokeRoot, "revoke-root", false, "Unseal the vault and revoke its initial root token instead of encrypting it. Use generate-root to create a new root token when one is needed")
+	flags.DurationVar(&RevokeWait, "revoke-wait", time.Minute, "Wait up to this long for the vault to become unsealed and active before revoking its initial root token")
+	flags.UintSliceVar(&RootSerials, "root-serial", []uint{}, "Select PIV devices to encrypt the root token file of --split for. By default, an attached device that does not receive an unseal-key is used")
+
+	CLI.AddCommand(&initialize)
 }
 
 // Initialize a new Vault instance and save it's encrypted secrets to a file
 func Initialize(cmd *cobra.Command, args []string) (err error) {
+	if InitSplit && RevokeRoot {
+		return fmt.Errorf("%w: --split can not be combined with --revoke-root", util.ErrFlags)
+	}
+
+	if len(RootSerials) > 0 && !InitSplit {
+		return fmt.Errorf("%w: --root-serial requires --split", util.ErrFlags)
+	}
+
 	vault, err := api.NewClient(&util.Vault)
 	if err != nil {
 		return
 	}
 
-	common.Logger.Info("Initializing vault with 1-of-1 secret", zap.String("endpoint", util.Vault.Address))
-	message, err := vault.Sys().Init(&api.InitRequest{
-		SecretShares:    1,
-		SecretThreshold: 1,
-	})
+	status, err := vault.Sys().SealStatusWithContext(cmd.Context())
+	if err != nil {
+		return
+	}
+
+	request := api.InitRequest{SecretShares: SecretShares, SecretThreshold: SecretThreshold}
+	shares := SecretShares
 
+	flags := cmd.Flags()
+	if status.RecoverySeal {
+		if flags.Changed("shares") || flags.Changed("threshold") {
+			return fmt.Errorf("%w: Vault uses a %s seal. Use --recovery-shares and --recovery-threshold", util.ErrFlags, status.Type)
+		}
+
+		request = api.InitRequest{RecoveryShares: RecoveryShares, RecoveryThreshold: RecoveryThreshold}
+		shares = RecoveryShares
+	} else if flags.Changed("recovery-shares") || flags.Changed("recovery-threshold") {
+		return fmt.Errorf("%w: --recovery-shares and --recovery-threshold require an auto-unseal seal. Vault uses a %s seal", util.ErrFlags, status.Type)
+	}
+
+	if shares > 1 && util.Quorum > 0 {
+		return fmt.Errorf("%w: --quorum can not be combined with multiple shares", util.ErrFlags)
+	}
+
+	// Select recipients for each file before initializing the vault
+	recipients, err := selectRecipients(shares)
 	if err != nil {
 		return
 	}
 
-	encrypted, err := envelope.Encrypt(message, util.Yubikey)
+	var root []envelope.Recipient
+	if InitSplit {
+		root, err = rootRecipients(recipients)
+		if err != nil {
+			return
+		}
+	}
+
+	common.Logger.Info("Initializing vault", zap.String("endpoint", util.Vault.Address), zap.String("seal", status.Type), zap.Bool("recovery", status.RecoverySeal), zap.Int("n", shares), zap.Bool("split", InitSplit))
+	message, err := vault.Sys().InitWithContext(cmd.Context(), &request)
+	if err != nil {
+		return
+	}
+
+	secrets := *message
+	if InitSplit || RevokeRoot {
+		secrets.RootToken = ""
+	}
+
+	err = writeShares(shareFiles(args[0], len(recipients)), &secrets, recipients)
+	if err != nil {
+		return
+	}
+
+	if InitSplit {
+		err = util.WriteEnvelope(util.RootFile(args[0]), &api.InitResponse{RootToken: message.RootToken}, util.Quorum, root)
+	}
+
+	if RevokeRoot {
+		err = revokeRoot(cmd.Context(), vault, message)
+	}
+
+	return
+}
+
+// ErrRevokeRoot is returned if init --revoke-root fails to revoke the initial root token
+var ErrRevokeRoot = errors.New("Unable to revoke the initial root token")
+
+// revokeRoot unseals a newly initialized vault and revokes its initial root token once the vault is active.
+// Vaults with an auto-unseal seal have no unseal-keys, and unseal themselves
+func revokeRoot(ctx context.Context, vault *api.Client, message *api.InitResponse) (err error) {
+	keys := message.Keys
+	if len(keys) > SecretThreshold {
+		keys = keys[:SecretThreshold]
+	}
+
+	for _, key := range keys {
+		common.Logger.Info("Unsealing vault to revoke initial root token", zap.String("endpoint", util.Vault.Address))
+
+		var status *api.SealStatusResponse
+		status, err = vault.Sys().UnsealWithContext(ctx, key)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrRevokeRoot, err)
+		}
+
+		if !status.Sealed {
+			break
+		}
+	}
+
+	err = waitForActive(ctx, vault, RevokeWait)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrRevokeRoot, err)
+	}
+
+	vault.SetToken(message.RootToken)
+
+	common.Logger.Info("Revoking initial root token")
+	err = vault.Auth().Token().RevokeSelfWithContext(ctx, "")
+	if err != nil {
+		// The token was not written to any file, but remains valid until it expires or is revoked
+		return fmt.Errorf("%w. It is still valid: revoke it by accessor with a token from generate-root: %w", ErrRevokeRoot, err)
+	}
+
+	return
+}
+
+// waitForActive polls Vault's seal status and leader endpoint until it is unsealed and active, or the timeout expires
+func waitForActive(ctx context.Context, vault *api.Client, timeout time.Duration) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		var status *api.SealStatusResponse
+		status, err = vault.Sys().SealStatusWithContext(ctx)
+		if err == nil && status.Sealed {
+			err = ErrSealed
+		}
+
+		if err == nil {
+			var leader *api.LeaderResponse
+			leader, err = vault.Sys().LeaderWithContext(ctx)
+			if err == nil && leader.HAEnabled && !leader.IsSelf {
+				err = fmt.Errorf("%s is not the active node", util.Vault.Address)
+			}
+		}
+
+		if err == nil {
+			return
+		}
+
+		common.Logger.Info("Waiting for vault to become active", zap.String("endpoint", util.Vault.Address), zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("vault was not active within %s: %w", timeout, err)
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// selectRecipients returns the recipients of each unseal-key share's file. A --recovery-passphrase
+// recipient is added to each file
+func selectRecipients(shares int) (recipients [][]envelope.Recipient, err error) {
+	if shares == 1 {
+		var selected []envelope.Recipient
+
+		selected, err = util.Recipients()
+		if err != nil {
+			return
+		}
+
+		return [][]envelope.Recipient{selected}, nil
+	}
+
+	selected, err := util.SelectRecipients(shares)
+	if err != nil {
+		return
+	}
+
+	recovery, err := util.Recovery()
+	if err != nil {
+		return
+	}
+
+	for _, recipient := range selected {
+		recipients = append(recipients, append([]envelope.Recipient{recipient}, recovery...))
+	}
+
+	return
+}
+
+// shareFiles returns the file that each share is written to: FILE, or a numbered file for each of multiple shares
+func shareFiles(name string, shares int) (names []string) {
+	if shares == 1 {
+		return []string{name}
+	}
+
+	for i := 1; i <= shares; i++ {
+		names = append(names, util.ShareFile(name, i))
+	}
+
+	return
+}
+
+// writeShares encrypts each unseal-key or recovery key share for its recipients, and writes it to the
+// matching file. The root token is included in each file, if set
+func writeShares(names []string, message *api.InitResponse, recipients [][]envelope.Recipient) (err error) {
+	for i, selected := range recipients {
+		secrets := api.InitResponse{RootToken: message.RootToken}
+
+		if len(message.RecoveryKeys) > 0 {
+			secrets.RecoveryKeys = message.RecoveryKeys[i : i+1]
+			secrets.RecoveryKeysB64 = message.RecoveryKeysB64[i : i+1]
+		} else {
+			secrets.Keys = message.Keys[i : i+1]
+			secrets.KeysB64 = message.KeysB64[i : i+1]
+		}
+
+		err = util.WriteEnvelope(names[i], &secrets, util.Quorum, selected)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// rootRecipients returns recipients for the root-token file of a --split init: the PIV devices selected with
+// --root-serial flags, or the first attached PIV device that does not receive an unseal-key
+func rootRecipients(unseal [][]envelope.Recipient) (recipients []envelope.Recipient, err error) {
+	var avoid []uint
+	for _, selected := range unseal {
+		for _, recipient := range selected {
+			if key, is := recipient.(envelope.KeyRecipient); is && key.Device > 0 {
+				avoid = append(avoid, uint(key.Device))
+			}
+		}
+	}
+
+	var cards []piv.Options
+	for _, serial := range RootSerials {
+		for _, device := range avoid {
+			if serial == device {
+				return nil, fmt.Errorf("%w: --root-serial %d also receives an unseal-key", util.ErrFlags, serial)
+			}
+		}
+
+		opts := util.Yubikey.Copy()
+		opts.Serial = uint32(serial)
+
+		cards = append(cards, opts)
+	}
+
+	if len(cards) == 0 {
+		opts := util.Yubikey.Copy()
+		opts.Serial = 0
+		opts.Avoid = append(opts.Avoid, avoid...)
+
+		cards = append(cards, opts)
+	}
+
+	for _, opts := range cards {
+		var recipient envelope.KeyRecipient
+
+		recipient, err = envelope.PIVRecipient(opts)
+		if err != nil {
+			return
+		}
+
+		recipients = append(recipients, recipient)
+	}
+
+	recovery, err := util.Recovery()
 	if err != nil {
 		return
 	}
 
-	common.Logger.Info("Writing encrypted vault secrets", zap.String("path", args[0]))
-	return common.WriteAtomic(args[0], encrypted, 0600)
+	return append(recipients, recovery...), nil
 }
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/jmanero/vault-yubikey-helper/cmd/util"
+	"github.com/jmanero/vault-yubikey-helper/pkg/common"
+	"github.com/jmanero/vault-yubikey-helper/pkg/envelope"
+	"github.com/jmanero/vault-yubikey-helper/pkg/piv"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"pault.ag/go/ykpiv"
+)
+
+var inspect = cobra.Command{
+	Use:   "inspect FILE",
+	Short: "Show the recipients and algorithms of an encrypted file without decrypting it",
+	RunE:  Inspect,
+	Args:  cobra.ExactArgs(1),
+
+	Long: `Show the recipients and algorithms of an encrypted file without decrypting it.
+
+Attached PIV devices are compared with each recipient's key ID to report whether
+the file can be opened on this host.`,
+}
+
+// Inspect options
+var (
+	InspectJSON bool
+)
+
+func init() {
+	flags := inspect.PersistentFlags()
+	flags.BoolVar(&InspectJSON, "json", false, "Print envelope metadata as JSON")
+
+	CLI.AddCommand(&inspect)
+}
+
+// StanzaInfo describes a single recipient of an envelope
+type StanzaInfo struct {
+	Algorithm string `json:"alg"`
+	Device    uint32 `json:"serial,omitempty"`
+	KeyID     string `json:"kid"`
+	Curve     string `json:"curve,omitempty"`
+	KDF       string `json:"kdf,omitempty"`
+	Wrapping  string `json:"wrap,omitempty"`
+	Attached  bool   `json:"attached"`
+}
+
+// EnvelopeInfo describes an envelope's format and recipients
+type EnvelopeInfo struct {
+	Path       string       `json:"path"`
+	Version    int          `json:"version"`
+	Algorithm  string       `json:"alg"`
+	Threshold  int          `json:"threshold"`
+	NonceSize  int          `json:"nonce_size"`
+	Length     int          `json:"ciphertext_length"`
+	Recipients []StanzaInfo `json:"recipients"`
+	Attached   int          `json:"attached"`
+	Openable   bool         `json:"openable"`
+}
+
+// Inspect parses an envelope and prints its metadata
+func Inspect(cmd *cobra.Command, args []string) (err error) {
+	encrypted, err := os.ReadFile(args[0])
+	if err != nil {
+		return
+	}
+
+	reader, err := envelope.Parse(encrypted)
+	if err != nil {
+		return
+	}
+
+	info := EnvelopeInfo{
+		Path:      args[0],
+		Version:   reader.Version,
+		Algorithm: reader.Algorithm,
+		Threshold: reader.Threshold,
+		NonceSize: len(reader.Nonce),
+		Length:    len(reader.Encrypted),
+	}
+
+	// Read the key-management slots of all attached devices
+	opts := util.Yubikey.WithSlot(ykpiv.KeyManagement)
+	opts.Serial = 0
+
+	cards, _, err1 := piv.Scan(opts)
+	if err1 != nil {
+		common.Logger.Warn("Unable to read some PIV devices", zap.Error(err1))
+	}
+
+	for _, stanza := range reader.Recipients {
+		recipient := StanzaInfo{Algorithm: stanza.Algorithm, Device: stanza.Device, KeyID: stanza.KeyID}
+
+		switch stanza.Algorithm {
+		case envelope.SchemeECDH:
+			var meta envelope.ECMetadata
+			if json.Unmarshal(stanza.Metadata, &meta) == nil {
+				recipient.KDF = meta.KDF
+
+				if curve, err1 := meta.Curve(); err1 == nil {
+					recipient.Curve = curve.Params().Name
+				}
+			}
+
+		case envelope.SchemeScrypt:
+			var meta envelope.ScryptMetadata
+			if json.Unmarshal(stanza.Metadata, &meta) == nil {
+				recipient.KDF = fmt.Sprintf("scrypt N=%d r=%d p=%d", meta.N, meta.R, meta.P)
+			}
+
+		case envelope.SchemeRSA:
+			var meta envelope.RSAMetadata
+			if json.Unmarshal(stanza.Metadata, &meta) == nil {
+				recipient.Wrapping = meta.Algorithm
+				if len(recipient.Wrapping) == 0 {
+					recipient.Wrapping = envelope.RSAPKCS1v15
+				}
+			}
+		}
+
+		// Decryption matches attached devices by key ID, regardless of their serial numbers
+		for _, card := range cards {
+			if common.MatchFingerprint(card.PublicKey, stanza.KeyID) {
+				recipient.Attached = true
+				info.Attached++
+				break
+			}
+		}
+
+		info.Recipients = append(info.Recipients, recipient)
+	}
+
+	need := 1
+	if info.Threshold > 0 {
+		need = info.Threshold
+	}
+
+	info.Openable = info.Attached >= need
+
+	if InspectJSON {
+		var data []byte
+		data, err = common.MarshalJSON(info)
+		if err != nil {
+			return
+		}
+
+		_, err = cmd.OutOrStdout().Write(data)
+		return
+	}
+
+	cmd.Printf("%s\n\tversion:   %d\n\talgorithm: %s\n\tthreshold: %d of %d\n\tnonce:     %d bytes\n\tencrypted: %d bytes\n",
+		info.Path, info.Version, info.Algorithm, need, len(info.Recipients), info.NonceSize, info.Length)
+
+	for i, recipient := range info.Recipients {
+		cmd.Printf("\trecipient %d: %s\n\t\tserial:   %d\n\t\tkey-id:   %s\n", i, recipient.Algorithm, recipient.Device, recipient.KeyID)
+
+		if len(recipient.Curve) > 0 {
+			cmd.Printf("\t\tcurve:    %s\n", recipient.Curve)
+		}
+
+		if len(recipient.KDF) > 0 {
+			cmd.Printf("\t\tkdf:      %s\n", recipient.KDF)
+		}
+
+		if len(recipient.Wrapping) > 0 {
+			cmd.Printf("\t\twrapping: %s\n", recipient.Wrapping)
+		}
+
+		cmd.Printf("\t\tattached: %t\n", recipient.Attached)
+	}
+
+	cmd.Printf("\topenable:  %t (%d of %d required PIV devices attached)\n", info.Openable, info.Attached, need)
+	return
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"path/filepath"
 	"time"
@@ -8,8 +10,8 @@ import (
 	"github.com/hashicorp/vault/api"
 	"github.com/jmanero/vault-yubikey-helper/cmd/util"
 	"github.com/jmanero/vault-yubikey-helper/pkg/common"
-	"github.com/jmanero/vault-yubikey-helper/pkg/envelope"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"go.uber.org/zap"
 )
 
@@ -35,14 +37,16 @@ func init() {
 		TokenPath = filepath.Join(home, ".vault-token")
 	}
 
-	flags := login.PersistentFlags()
+	TokenFlags(login.PersistentFlags())
+	CLI.AddCommand(&login)
+}
 
+// TokenFlags registers flags for tokens requested by RequestToken
+func TokenFlags(flags *pflag.FlagSet) {
 	flags.StringVar(&TokenRole, "token-role", "", "Optional role for acquired token")
 	flags.StringArrayVar(&TokenPolicies, "token-policy", []string{}, "Optional policies for acquired token")
 	flags.StringVar(&TokenPath, "token-path", TokenPath, "Path to write acquired token")
 	flags.DurationVar(&TokenTTL, "token-ttl", time.Hour, "TTL for acquired token")
-
-	CLI.AddCommand(&login)
 }
 
 // Login to a Vault instance using an encrypted root-token
@@ -52,18 +56,23 @@ func Login(cmd *cobra.Command, args []string) (err error) {
 		return
 	}
 
-	common.Logger.Info("Reading encrypted vault secrets", zap.String("path", args[0]))
-	encrypted, err := os.ReadFile(args[0])
+	var message api.InitResponse
+	_, err = util.ReadEnvelope(args[0], &message)
 	if err != nil {
 		return
 	}
 
-	var message api.InitResponse
-	envelope.Decrypt(encrypted, &message, util.Yubikey.Pin)
+	if len(message.RootToken) == 0 {
+		return fmt.Errorf("%w: %s. Use the root token file written by init --split", util.ErrNoRootToken, args[0])
+	}
 
 	// use the root token to request a scoped token
 	vault.SetToken(message.RootToken)
+	return RequestToken(cmd.Context(), vault)
+}
 
+// RequestToken uses the client's root token to request a token with the --token-role or --token-policy flags, and writes it to --token-path
+func RequestToken(ctx context.Context, vault *api.Client) (err error) {
 	req := api.TokenCreateRequest{
 		Policies: TokenPolicies,
 		NoParent: true,
@@ -73,10 +82,10 @@ func Login(cmd *cobra.Command, args []string) (err error) {
 	var secret *api.Secret
 	if len(TokenRole) > 0 {
 		common.Logger.Info("Requesting token with role")
-		secret, err = vault.Auth().Token().CreateWithRoleWithContext(cmd.Context(), &req, TokenRole)
+		secret, err = vault.Auth().Token().CreateWithRoleWithContext(ctx, &req, TokenRole)
 	} else {
 		common.Logger.Info("Requesting orphan token")
-		secret, err = vault.Auth().Token().CreateOrphanWithContext(cmd.Context(), &req)
+		secret, err = vault.Auth().Token().CreateOrphanWithContext(ctx, &req)
 	}
 
 	if err != nil {
@@ -84,7 +93,5 @@ func Login(cmd *cobra.Command, args []string) (err error) {
 	}
 
 	common.Logger.Info("Writing token to file", zap.String("lease_id", secret.LeaseID), zap.Int("lease_duration", secret.LeaseDuration), zap.String("path", TokenPath))
-	common.WriteAtomic(TokenPath, []byte(secret.Auth.ClientToken), 0600)
-
-	return
+	return common.WriteAtomic(TokenPath, []byte(secret.Auth.ClientToken), 0600)
 }
@@ -13,7 +13,10 @@ import (
 )
 
 // CLI root
-var CLI = cobra.Command{Use: "vault-yubikey-helper"}
+var CLI = cobra.Command{
+	Use:              "vault-yubikey-helper",
+	PersistentPreRun: util.SelectSerial,
+}
 
 func init() {
 	// Register sub-commands
@@ -30,9 +33,13 @@ func init() {
 
 	// Yubikey flags
 	flags.StringVar(&util.Yubikey.Pin, "pin", "123456", "PIN required to use the PIV device's private key for decryption. Set environment variable YUBIKEY_PIN to avoid reveling in logs")
-	flags.Uint32Var(&util.Yubikey.Serial, "serial", 0, "Select the PIV device to use for init or re-encrypt operations by its serial number")
+	flags.UintSliceVar(&util.Serials, "serial", []uint{}, "Select PIV devices to use for init or re-encrypt operations by their serial numbers. Repeat to encrypt for multiple devices")
 	flags.UintSliceVar(&util.Yubikey.Avoid, "avoid-serial", []uint{}, "Exclude PIV devices from auto-selection by their serial numbers")
 	flags.BoolVar(&util.Yubikey.Verbose, "verbose", false, "Enable verbose logging from the PIV library")
+
+	// Software key flags
+	flags.StringArrayVar(&util.IdentityFiles, "identity", []string{}, "Decrypt with a PEM encoded private key file before trying attached PIV devices")
+	flags.BoolVar(&util.RecoveryPassphrase, "recovery-passphrase", false, "Also encrypt for, or decrypt with, a recovery passphrase. Set environment variable VAULT_RECOVERY_PASSPHRASE or enter it at a prompt")
 }
 
 func main() {
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jmanero/vault-yubikey-helper/cmd/util"
+	"github.com/jmanero/vault-yubikey-helper/pkg/common"
+	"github.com/jmanero/vault-yubikey-helper/pkg/envelope"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+func init() {
+	CLI.AddCommand(&cobra.Command{
+		Use:    "migrate FILE...",
+		Short:  "Upgrade encrypted files to the current envelope format in place",
+		PreRun: util.PinFromEnvironment,
+		RunE:   Migrate,
+		Args:   cobra.MinimumNArgs(1),
+
+		Long: `Upgrade encrypted files to the current envelope format in place.
+
+Each file is decrypted and re-encrypted for all of its original recipients. PIV
+devices must be attached to the host, and still hold the key of their recipient.
+Software recipients must be given as --identity files.`,
+	})
+}
+
+// Migrate re-encrypts envelopes with older format versions for the same recipients
+func Migrate(cmd *cobra.Command, args []string) (err error) {
+	identities, err := util.Identities()
+	if err != nil {
+		return
+	}
+
+	for _, name := range args {
+		common.Logger.Info("Reading encrypted file", zap.String("path", name))
+
+		var encrypted []byte
+		encrypted, err = os.ReadFile(name)
+		if err != nil {
+			return
+		}
+
+		var reader envelope.Reader
+		reader, err = envelope.Parse(encrypted)
+		if err != nil {
+			return
+		}
+
+		if reader.Version == envelope.Version {
+			common.Logger.Info("Envelope format is current", zap.String("path", name), zap.Int("version", reader.Version))
+			continue
+		}
+
+		// Payloads are kept as raw bytes, as files written by the encrypt command may not hold JSON
+		var data []byte
+		data, _, err = envelope.Open(encrypted, identities...)
+		if err != nil {
+			return
+		}
+
+		var recipients []envelope.Recipient
+		recipients, err = util.StanzaRecipients(reader.Recipients, identities)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+
+		encrypted, err = envelope.Seal(data, reader.Threshold, recipients...)
+		if err != nil {
+			return
+		}
+
+		common.Logger.Info("Writing migrated file", zap.String("path", name), zap.Int("from", reader.Version), zap.Int("to", envelope.Version))
+		err = common.WriteAtomic(name, encrypted, 0600)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
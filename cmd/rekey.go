@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/jmanero/vault-yubikey-helper/cmd/util"
+	"github.com/jmanero/vault-yubikey-helper/pkg/common"
+	"github.com/jmanero/vault-yubikey-helper/pkg/envelope"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var rekey = cobra.Command{
+	Use:    "rekey FILE...",
+	Short:  "Generate new unseal-keys with decrypted unseal-keys, and encrypt them for PIV devices",
+	PreRun: util.PinFromEnvironment,
+	RunE:   Rekey,
+	Args:   cobra.MinimumNArgs(1),
+
+	Long: `Generate new unseal-keys with decrypted unseal-keys, and encrypt them for PIV devices.
+
+Unseal-keys are decrypted from each FILE that can be decrypted with an attached
+PIV device, and submitted to Vault's rekey endpoint. Recipients for the new
+keys and --pgp-key files are checked before the rekey is started.
+
+Vault does not use the new keys until they are verified. They are first written
+beside --output, or numbered files for multiple --shares, and checked to decrypt
+with attached PIV devices. Only then are they submitted back to Vault, and the
+new files moved into place. Replaced files and input files that are not
+replaced are kept as FILE.TIMESTAMP backups, as their keys are no longer valid.
+
+If Vault uses an auto-unseal seal, its recovery keys are rekeyed instead, with
+recovery keys decrypted from each FILE. --shares and --threshold then set the
+number of recovery key shares.`,
+}
+
+// Errors
+var (
+	ErrRekeyStarted    = errors.New("A rekey attempt is already in progress")
+	ErrRekeyIncomplete = errors.New("Rekey did not complete")
+)
+
+// Rekey options
+var (
+	RekeyShares    int
+	RekeyThreshold int
+	RekeyCancel    bool
+	RekeyOutput    string
+)
+
+func init() {
+	flags := rekey.PersistentFlags()
+	util.RecipientFlags(flags)
+	util.EscrowFlags(flags)
+	flags.IntVar(&RekeyShares, "shares", 0, "Number of new unseal-key shares to generate. Defaults to the current number of shares")
+	flags.IntVar(&RekeyThreshold, "threshold", 0, "Number of new unseal-key shares required to unseal the vault. Defaults to the current threshold")
+	flags.BoolVar(&RekeyCancel, "cancel", false, "Cancel a rekey attempt that is already in progress")
+	flags.StringVar(&RekeyOutput, "output", "", "File to write new unseal-keys to, numbered for multiple shares like init. Defaults to FILE if only one is given")
+
+	CLI.AddCommand(&rekey)
+}
+
+// Rekey drives Vault's rekey flow with decrypted unseal-keys, and encrypts the new keys
+func Rekey(cmd *cobra.Command, args []string) (err error) {
+	output := RekeyOutput
+	if len(output) == 0 {
+		if len(args) > 1 {
+			return fmt.Errorf("%w: --output is required with more than one FILE", util.ErrFlags)
+		}
+
+		output = args[0]
+	}
+
+	vault, err := api.NewClient(&util.Vault)
+	if err != nil {
+		return
+	}
+
+	status, err := vault.Sys().SealStatusWithContext(cmd.Context())
+	if err != nil {
+		return
+	}
+
+	if RekeyShares == 0 {
+		RekeyShares = status.N
+	}
+
+	if RekeyThreshold == 0 {
+		RekeyThreshold = status.T
+	}
+
+	if RekeyShares > 1 && util.Quorum > 0 {
+		return fmt.Errorf("%w: --quorum can not be combined with multiple --shares", util.ErrFlags)
+	}
+
+	err = util.CheckQuorum()
+	if err != nil {
+		return
+	}
+
+	message, err := util.ReadSecrets(args)
+	if err != nil {
+		return
+	}
+
+	keys, err := util.OperationKeys(message, status)
+	if err != nil {
+		return
+	}
+
+	// Select recipients for each file, and check --pgp-key files before starting the rekey
+	recipients, err := selectRecipients(RekeyShares)
+	if err != nil {
+		return
+	}
+
+	_, err = util.EscrowKeys()
+	if err != nil {
+		return
+	}
+
+	ctx := cmd.Context()
+	endpoints := rekeyEndpoints(vault, status.RecoverySeal)
+
+	result, err := rekeyKeys(ctx, endpoints, keys)
+	if err != nil {
+		return
+	}
+
+	names := shareFiles(output, len(recipients))
+	staged := make([]string, len(names))
+	for i, name := range names {
+		staged[i] = name + rekeyStaging
+	}
+
+	// Vault keeps using the current keys until the new keys are verified
+	var verified bool
+	defer func() {
+		if err != nil && !verified {
+			common.Logger.Warn("Canceling unverified rekey attempt. Vault still uses the current keys")
+			endpoints.Cancel(ctx)
+			removeStaged(staged)
+		}
+	}()
+
+	// Keep the root token of the original files, if any
+	message = api.InitResponse{RootToken: message.RootToken}
+	if status.RecoverySeal {
+		message.RecoveryKeys, message.RecoveryKeysB64 = result.Keys, result.KeysB64
+	} else {
+		message.Keys, message.KeysB64 = result.Keys, result.KeysB64
+	}
+
+	err = writeShares(staged, &message, recipients)
+	if err != nil {
+		return
+	}
+
+	err = checkStaged(staged, result.Keys)
+	if err != nil {
+		return
+	}
+
+	err = rekeyVerify(ctx, endpoints, result)
+	if err != nil {
+		return
+	}
+
+	// The new keys are in use. Staged files must be kept if they can not be moved into place
+	verified = true
+
+	err = installStaged(args, names, staged)
+	if err != nil {
+		return fmt.Errorf("%w. Vault uses the new keys in the %s files", err, rekeyStaging)
+	}
+
+	return
+}
+
+// rekeyStaging is appended to the names of new files until Vault has verified their keys
+const rekeyStaging = ".rekey"
+
+// rekeyAPI selects the rekey endpoints for unseal-keys, or for recovery keys
+type rekeyAPI struct {
+	Status func(ctx context.Context) (*api.RekeyStatusResponse, error)
+	Cancel func(ctx context.Context) error
+	Init   func(ctx context.Context, config *api.RekeyInitRequest) (*api.RekeyStatusResponse, error)
+	Update func(ctx context.Context, shard, nonce string) (*api.RekeyUpdateResponse, error)
+	Verify func(ctx context.Context, shard, nonce string) (*api.RekeyVerificationUpdateResponse, error)
+}
+
+// rekeyEndpoints returns the rekey endpoints for a vault's unseal-keys, or its recovery keys for auto-unseal seals
+func rekeyEndpoints(vault *api.Client, recovery bool) rekeyAPI {
+	sys := vault.Sys()
+	if recovery {
+		return rekeyAPI{
+			Status: sys.RekeyRecoveryKeyStatusWithContext,
+			Cancel: sys.RekeyRecoveryKeyCancelWithContext,
+			Init:   sys.RekeyRecoveryKeyInitWithContext,
+			Update: sys.RekeyRecoveryKeyUpdateWithContext,
+			Verify: sys.RekeyRecoveryKeyVerificationUpdateWithContext,
+		}
+	}
+
+	return rekeyAPI{
+		Status: sys.RekeyStatusWithContext,
+		Cancel: sys.RekeyCancelWithContext,
+		Init:   sys.RekeyInitWithContext,
+		Update: sys.RekeyUpdateWithContext,
+		Verify: sys.RekeyVerificationUpdateWithContext,
+	}
+}
+
+// rekeyKeys submits keys to a new rekey attempt that requires verification, and returns the new keys
+func rekeyKeys(ctx context.Context, endpoints rekeyAPI, keys []string) (result *api.RekeyUpdateResponse, err error) {
+	status, err := endpoints.Status(ctx)
+	if err != nil {
+		return
+	}
+
+	if status.Started {
+		if !RekeyCancel {
+			return nil, fmt.Errorf("%w: progress %d of %d. Use --cancel to restart it", ErrRekeyStarted, status.Progress, status.Required)
+		}
+
+		common.Logger.Warn("Canceling rekey attempt", zap.Int("progress", status.Progress), zap.Int("required", status.Required))
+		err = endpoints.Cancel(ctx)
+		if err != nil {
+			return
+		}
+	}
+
+	common.Logger.Info("Starting rekey", zap.String("endpoint", util.Vault.Address), zap.Int("t", RekeyThreshold), zap.Int("n", RekeyShares))
+	status, err = endpoints.Init(ctx, &api.RekeyInitRequest{
+		SecretShares:        RekeyShares,
+		SecretThreshold:     RekeyThreshold,
+		RequireVerification: true,
+	})
+
+	if err != nil {
+		return
+	}
+
+	// Don't leave an incomplete attempt behind
+	defer func() {
+		if err != nil {
+			common.Logger.Warn("Canceling incomplete rekey attempt")
+			endpoints.Cancel(ctx)
+		}
+	}()
+
+	for _, key := range keys {
+		common.Logger.Info("Submitting key for rekey", zap.Int("progress", status.Progress), zap.Int("required", status.Required))
+		result, err = endpoints.Update(ctx, key, status.Nonce)
+		if err != nil {
+			return
+		}
+
+		if result.Complete {
+			break
+		}
+	}
+
+	if result == nil || !result.Complete {
+		return nil, fmt.Errorf("%w: submitted %d of %d unseal-keys", ErrRekeyIncomplete, len(keys), status.Required)
+	}
+
+	if !result.VerificationRequired {
+		return nil, fmt.Errorf("%w: Vault did not require verification of the new keys", ErrRekeyIncomplete)
+	}
+
+	return
+}
+
+// rekeyVerify submits new keys back to Vault, after which it uses them
+func rekeyVerify(ctx context.Context, endpoints rekeyAPI, result *api.RekeyUpdateResponse) (err error) {
+	for _, key := range result.Keys[:RekeyThreshold] {
+		common.Logger.Info("Verifying new key", zap.String("nonce", result.VerificationNonce))
+
+		var verified *api.RekeyVerificationUpdateResponse
+		verified, err = endpoints.Verify(ctx, key, result.VerificationNonce)
+		if err != nil {
+			return
+		}
+
+		if verified.Complete {
+			common.Logger.Info("Rekey verification complete")
+			return
+		}
+	}
+
+	return fmt.Errorf("%w: verification did not complete", ErrRekeyIncomplete)
+}
+
+// checkStaged reads back each staged file, and checks that it holds its new key if it can be decrypted with an attached PIV device
+func checkStaged(staged []string, keys []string) (err error) {
+	for i, name := range staged {
+		var encrypted []byte
+		encrypted, err = os.ReadFile(name)
+		if err != nil {
+			return
+		}
+
+		_, err = envelope.Parse(encrypted)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+
+		var secrets api.InitResponse
+		_, err1 := util.ReadEnvelope(name, &secrets)
+		if errors.Is(err1, envelope.ErrNoMatch) || errors.Is(err1, envelope.ErrNoQuorum) {
+			common.Logger.Warn("Unable to check new file without its PIV devices attached", zap.String("path", name), zap.Error(err1))
+			continue
+		}
+
+		if err1 != nil {
+			return fmt.Errorf("%s: %w", name, err1)
+		}
+
+		held := append(secrets.Keys, secrets.RecoveryKeys...)
+		if len(held) != 1 || held[0] != keys[i] {
+			return fmt.Errorf("%w: %s does not hold its new key", ErrRekeyIncomplete, name)
+		}
+	}
+
+	return
+}
+
+// removeStaged removes staged files and their escrow copies after a failed rekey
+func removeStaged(staged []string) {
+	for _, name := range staged {
+		for _, file := range []string{name, name + ".asc"} {
+			if err := os.Remove(file); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				common.Logger.Warn("Unable to remove staged file", zap.String("path", file), zap.Error(err))
+			}
+		}
+	}
+}
+
+// installStaged moves verified files into place, keeping backups of the files that they replace, and
+// moves input files that are not replaced to backups, as their keys are no longer valid
+func installStaged(inputs, names, staged []string) (err error) {
+	written := make(map[string]struct{})
+
+	for i, name := range names {
+		written[name] = struct{}{}
+
+		files := [][2]string{{staged[i], name}}
+		if len(util.PGPKeyFiles) > 0 {
+			files = append(files, [2]string{staged[i] + ".asc", name + ".asc"})
+		}
+
+		for _, file := range files {
+			_, err = util.Backup(file[1])
+			if err != nil {
+				return
+			}
+
+			common.Logger.Info("Writing new keys", zap.String("path", file[1]))
+			err = os.Rename(file[0], file[1])
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	for _, name := range inputs {
+		if _, has := written[name]; has {
+			continue
+		}
+
+		var backup string
+		backup, err = util.Backup(name)
+		if err != nil {
+			return
+		}
+
+		common.Logger.Info("Removing file with replaced keys", zap.String("path", name), zap.String("backup", backup))
+		err = os.Remove(name)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
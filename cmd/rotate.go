@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jmanero/vault-yubikey-helper/cmd/util"
+	"github.com/jmanero/vault-yubikey-helper/pkg/common"
+	"github.com/jmanero/vault-yubikey-helper/pkg/envelope"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var rotate = cobra.Command{
+	Use:    "rotate --from-serial OLD --to-serial NEW PATH...",
+	Short:  "Replace a Yubikey with another as a recipient of encrypted files",
+	PreRun: util.PinFromEnvironment,
+	RunE:   Rotate,
+	Args:   cobra.MinimumNArgs(1),
+
+	Long: `Replace a Yubikey with another as a recipient of encrypted files.
+
+Each file is decrypted, and encrypted under a new data-key for the --to-serial
+Yubikey in place of the --from-serial Yubikey, and for its other recipients.
+Threshold envelopes are split again, so shares held by the --from-serial Yubikey
+are no longer valid. The original file is copied to PATH.TIMESTAMP, and the new
+file is verified to decrypt with the --to-serial Yubikey before it replaces the
+original.
+
+Other PIV recipients must be attached, and other software recipients given as
+--identity or --to-recipient files. Yubikeys must share the same PIN. Backups and
+other earlier copies of each file can still be decrypted with the --from-serial
+Yubikey, and should be destroyed if it was lost.`,
+}
+
+// Rotate options
+var (
+	RotateFrom uint
+	RotateTo   uint
+)
+
+func init() {
+	flags := rotate.PersistentFlags()
+	flags.UintVar(&RotateFrom, "from-serial", 0, "Serial number of the Yubikey to remove from each file's recipients")
+	flags.UintVar(&RotateTo, "to-serial", 0, "Serial number of the attached Yubikey to add to each file's recipients")
+	flags.StringArrayVar(&util.RecipientFiles, "to-recipient", []string{}, "PEM encoded public-key or certificate file of another software recipient of each file, to encrypt for it again")
+
+	rotate.MarkPersistentFlagRequired("from-serial")
+	rotate.MarkPersistentFlagRequired("to-serial")
+
+	CLI.AddCommand(&rotate)
+}
+
+// Rotate re-encrypts the data-keys of envelopes for a replacement PIV device
+func Rotate(cmd *cobra.Command, args []string) (err error) {
+	if RotateFrom == RotateTo {
+		return fmt.Errorf("%w: --from-serial and --to-serial must be different", util.ErrFlags)
+	}
+
+	identities, err := util.Identities()
+	if err != nil {
+		return
+	}
+
+	opts := util.Yubikey.Copy()
+	opts.Serial = uint32(RotateTo)
+
+	recipient, err := envelope.PIVRecipient(opts)
+	if err != nil {
+		return
+	}
+
+	match := func(stanza envelope.Stanza) bool {
+		return stanza.Device == uint32(RotateFrom)
+	}
+
+	resolve := func(stanzas []envelope.Stanza) ([]envelope.Recipient, error) {
+		return util.StanzaRecipients(stanzas, identities)
+	}
+
+	for _, name := range args {
+		common.Logger.Info("Reading encrypted file", zap.String("path", name))
+
+		var encrypted []byte
+		encrypted, err = os.ReadFile(name)
+		if err != nil {
+			return
+		}
+
+		var rotated []byte
+		rotated, err = envelope.Replace(encrypted, match, recipient, resolve, identities...)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+
+		err = verifyRotation(rotated, identities)
+		if err != nil {
+			return fmt.Errorf("%s: verification failed: %w", name, err)
+		}
+
+		_, err = util.Backup(name)
+		if err != nil {
+			return
+		}
+
+		common.Logger.Info("Writing rotated file", zap.String("path", name), zap.Uint("from", RotateFrom), zap.Uint("to", RotateTo))
+		err = common.WriteAtomic(name, rotated, 0600)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// verifyRotation checks that a rotated envelope decrypts, and that the new recipient's stanza can be unwrapped
+func verifyRotation(rotated []byte, identities []envelope.Identity) (err error) {
+	_, _, err = envelope.Open(rotated, identities...)
+	if err != nil {
+		return
+	}
+
+	reader, err := envelope.Parse(rotated)
+	if err != nil {
+		return
+	}
+
+	for _, stanza := range reader.Recipients {
+		if stanza.Device == uint32(RotateTo) {
+			_, err = envelope.PIVIdentity{Options: util.Yubikey.Copy()}.Unwrap(stanza)
+			return
+		}
+	}
+
+	return envelope.ErrRecipientNotFound
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/jmanero/vault-yubikey-helper/cmd/util"
+	"github.com/jmanero/vault-yubikey-helper/pkg/common"
+	"github.com/jmanero/vault-yubikey-helper/pkg/envelope"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+// Errors
+var (
+	ErrNotMigrating        = errors.New("Vault is not in seal migration mode")
+	ErrMigrationIncomplete = errors.New("Seal migration did not complete")
+)
+
+// MigrationWait bounds the wait for a seal migration to complete if --wait is not set
+const MigrationWait = 2 * time.Minute
+
+// migrateSeal unseals a vault in seal migration mode with decrypted unseal-keys, and rewrites the encrypted files
+// once the migration is confirmed and its unseal-keys have become recovery keys of an auto-unseal seal
+func migrateSeal(cmd *cobra.Command, args []string) (err error) {
+	vault, err := api.NewClient(&util.Vault)
+	if err != nil {
+		return
+	}
+
+	status, err := vault.Sys().SealStatusWithContext(cmd.Context())
+	if err != nil {
+		return util.Exit{Code: util.ExitVaultUnreachable, Err: err}
+	}
+
+	common.Logger.Info("Vault seal status", zap.String("seal", status.Type), zap.Bool("sealed", status.Sealed), zap.Bool("migration", status.Migration), zap.Bool("recovery", status.RecoverySeal))
+
+	switch {
+	case status.Migration:
+		message, err1 := util.ReadSecrets(args)
+		if err1 != nil {
+			return util.CardExit(err1)
+		}
+
+		if len(message.Keys) == 0 {
+			return fmt.Errorf("%w: seal migration requires the current unseal-keys", util.ErrNoUnsealKeys)
+		}
+
+		for _, key := range message.Keys {
+			common.Logger.Info("Unsealing vault for seal migration", zap.String("endpoint", util.Vault.Address), zap.Int("progress", status.Progress), zap.Int("t", status.T))
+
+			status, err = vault.Sys().UnsealWithOptionsWithContext(cmd.Context(), &api.UnsealOpts{Key: key, Migrate: true})
+			if err != nil {
+				return
+			}
+
+			if !status.Sealed {
+				break
+			}
+		}
+
+		if status.Sealed {
+			return util.Exit{Code: util.ExitSealed, Err: fmt.Errorf("%w: seal migration progress %d of %d", ErrSealed, status.Progress, status.T)}
+		}
+
+		// Standby nodes stay in migration mode until the active node has migrated the seal
+		leader, err1 := vault.Sys().LeaderWithContext(cmd.Context())
+		if err1 == nil && leader.HAEnabled && !leader.IsSelf {
+			common.Logger.Info("Unsealed standby node for seal migration. Files are rewritten when the active node is migrated", zap.String("endpoint", util.Vault.Address))
+			return
+		}
+
+		timeout := UnsealWait
+		if timeout == 0 {
+			timeout = MigrationWait
+		}
+
+		// Migration completes after the unseal response
+		status, err = waitForMigration(cmd.Context(), vault, timeout)
+		if err != nil {
+			return
+		}
+
+	default:
+		return ErrNotMigrating
+	}
+
+	if !status.RecoverySeal {
+		common.Logger.Info("Seal migration complete. Vault does not use recovery keys", zap.String("seal", status.Type))
+		return
+	}
+
+	return rewriteRecoveryKeys(args)
+}
+
+// waitForMigration polls Vault's seal status until it leaves migration mode, or the timeout expires
+func waitForMigration(ctx context.Context, vault *api.Client, timeout time.Duration) (status *api.SealStatusResponse, err error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		status, err = vault.Sys().SealStatusWithContext(ctx)
+		if err == nil && !status.Migration {
+			common.Logger.Info("Seal migration complete", zap.String("seal", status.Type), zap.Bool("recovery", status.RecoverySeal))
+			return
+		}
+
+		common.Logger.Info("Waiting for seal migration to complete", zap.String("endpoint", util.Vault.Address), zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w within %s. Files were not rewritten: run unseal --migrate on the active node", ErrMigrationIncomplete, timeout)
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// rewriteRecoveryKeys moves the unseal-keys of each encrypted file to its recovery keys, re-encrypting it
+// for its original recipients and threshold. The original file is copied to FILE.TIMESTAMP first
+func rewriteRecoveryKeys(names []string) (err error) {
+	identities, err := util.Identities()
+	if err != nil {
+		return
+	}
+
+	for _, name := range names {
+		var encrypted []byte
+		encrypted, err = os.ReadFile(name)
+		if err != nil {
+			return
+		}
+
+		var reader envelope.Reader
+		reader, err = envelope.Parse(encrypted)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+
+		var message api.InitResponse
+		if _, err1 := util.ReadEnvelope(name, &message); err1 != nil {
+			common.Logger.Warn("Unable to decrypt vault secrets. Skipping", zap.String("path", name), zap.Error(err1))
+			continue
+		}
+
+		if len(message.Keys) == 0 {
+			common.Logger.Info("File has no unseal-keys to rewrite", zap.String("path", name))
+			continue
+		}
+
+		var recipients []envelope.Recipient
+		recipients, err = util.StanzaRecipients(reader.Recipients, identities)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+
+		moved := len(message.Keys)
+		message.RecoveryKeys = append(message.RecoveryKeys, message.Keys...)
+		message.RecoveryKeysB64 = append(message.RecoveryKeysB64, message.KeysB64...)
+		message.Keys, message.KeysB64 = nil, nil
+
+		_, err = util.Backup(name)
+		if err != nil {
+			return
+		}
+
+		common.Logger.Info("Writing recovery keys", zap.String("path", name), zap.Int("keys", moved))
+		err = util.WriteEnvelope(name, message, reader.Threshold, recipients)
+		if err != nil {
+			return
+		}
+	}
+
+	return
+}
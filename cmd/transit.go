@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/jmanero/vault-yubikey-helper/cmd/util"
+	"github.com/jmanero/vault-yubikey-helper/pkg/common"
+	"github.com/jmanero/vault-yubikey-helper/pkg/systemd"
+	"github.com/jmanero/vault-yubikey-helper/pkg/transit"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var serveTransit = cobra.Command{
+	Use:    "serve-transit",
+	Short:  "Serve the subset of Vault's Transit API used by its transit seal, encrypting with PIV devices",
+	PreRun: util.PinFromEnvironment,
+	RunE:   ServeTransit,
+	Args:   cobra.NoArgs,
+
+	Long: `Serve the subset of Vault's Transit API used by its transit seal, encrypting with PIV devices.
+
+Vault's seal "transit" stanza can use this server to auto-unseal, so that a PIV
+device is the seal, without an unseal-key file. The encrypt and decrypt endpoints
+of --key under --mount-path, and auth/token/lookup-self are served. Plaintext is
+encrypted for recipients selected like the encrypt command, and decrypted with
+attached PIV devices.
+
+Clients must send the token from --token, the "transit-token" systemd credential,
+or environment variable VAULT_TRANSIT_TOKEN. The server checks that it can
+decrypt with the attached PIV devices before it starts listening.`,
+}
+
+// TransitCredential names the systemd credential that the transit server's token is read from
+const TransitCredential = "transit-token"
+
+// ErrNoTransitToken is returned if no token is configured for the transit server
+var ErrNoTransitToken = errors.New("A token is required to serve transit requests")
+
+// Transit server options
+var (
+	TransitListen  string
+	TransitMount   string
+	TransitKey     string
+	TransitToken   string
+	TransitTLSCert string
+	TransitTLSKey  string
+)
+
+func init() {
+	flags := serveTransit.PersistentFlags()
+	util.RecipientFlags(flags)
+	flags.StringVar(&TransitListen, "listen", "127.0.0.1:8250", "Address to listen for transit requests on")
+	flags.StringVar(&TransitMount, "mount-path", "transit", "Mount path of the transit API, matching the seal's mount_path")
+	flags.StringVar(&TransitKey, "key", "autounseal", "Name of the encryption key, matching the seal's key_name")
+	flags.StringVar(&TransitToken, "token", "", "Token that clients must send. Use systemd credential transit-token or environment variable VAULT_TRANSIT_TOKEN to avoid revealing it in logs")
+	flags.StringVar(&TransitTLSCert, "tls-cert", "", "PEM encoded certificate file to serve TLS with")
+	flags.StringVar(&TransitTLSKey, "tls-key", "", "PEM encoded private key file for --tls-cert")
+
+	CLI.AddCommand(&serveTransit)
+}
+
+// transitToken reads the transit server's token from its flag, a systemd credential, or an environment variable
+func transitToken() (token string, err error) {
+	if len(TransitToken) > 0 {
+		return TransitToken, nil
+	}
+
+	value, has, err := systemd.Credential(TransitCredential)
+	if err != nil {
+		return
+	}
+
+	if has {
+		common.Logger.Info("Using transit token from systemd credential", zap.String("name", TransitCredential))
+		return strings.TrimSpace(string(value)), nil
+	}
+
+	if value, has := os.LookupEnv("VAULT_TRANSIT_TOKEN"); has && len(value) > 0 {
+		common.Logger.Info("Using transit token from environment variable VAULT_TRANSIT_TOKEN")
+		return value, nil
+	}
+
+	return "", fmt.Errorf("%w: use --token, systemd credential %s, or environment variable VAULT_TRANSIT_TOKEN", ErrNoTransitToken, TransitCredential)
+}
+
+// ServeTransit serves transit encrypt and decrypt requests until the command's context is canceled
+func ServeTransit(cmd *cobra.Command, args []string) (err error) {
+	if (len(TransitTLSCert) > 0) != (len(TransitTLSKey) > 0) {
+		return fmt.Errorf("%w: --tls-cert and --tls-key must be given together", util.ErrFlags)
+	}
+
+	token, err := transitToken()
+	if err != nil {
+		return
+	}
+
+	recipients, err := util.Recipients()
+	if err != nil {
+		return util.CardExit(err)
+	}
+
+	identities, err := util.Identities()
+	if err != nil {
+		return
+	}
+
+	server := &transit.Server{
+		Mount:      strings.Trim(TransitMount, "/"),
+		Key:        TransitKey,
+		Token:      token,
+		Threshold:  util.Quorum,
+		Recipients: recipients,
+		Identities: identities,
+	}
+
+	// Fail before listening if attached PIV devices can not decrypt, e.g. due to a wrong PIN
+	common.Logger.Info("Checking that attached PIV devices can decrypt")
+	ciphertext, err := server.Encrypt([]byte("check"))
+	if err != nil {
+		return
+	}
+
+	_, err = server.Decrypt(ciphertext)
+	if err != nil {
+		return util.CardExit(err)
+	}
+
+	listener := http.Server{Addr: TransitListen, Handler: server.Handler()}
+
+	go func() {
+		<-cmd.Context().Done()
+
+		common.Logger.Info("Stopping transit server")
+		listener.Close()
+	}()
+
+	if err = systemd.Notify(systemd.Ready); err != nil {
+		common.Logger.Warn("Unable to notify systemd", zap.Error(err))
+	}
+
+	common.Logger.Info("Serving transit requests", zap.String("listen", TransitListen), zap.String("mount", server.Mount), zap.String("key", server.Key))
+	if len(TransitTLSCert) > 0 {
+		err = listener.ListenAndServeTLS(TransitTLSCert, TransitTLSKey)
+	} else {
+		err = listener.ListenAndServe()
+	}
+
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+
+	return
+}
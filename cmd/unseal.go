@@ -1,60 +1,211 @@
 package main
 
 import (
+	"context"
 	"errors"
-	"os"
+	"fmt"
+	"time"
 
 	"github.com/hashicorp/vault/api"
 	"github.com/jmanero/vault-yubikey-helper/cmd/util"
 	"github.com/jmanero/vault-yubikey-helper/pkg/common"
-	"github.com/jmanero/vault-yubikey-helper/pkg/envelope"
+	"github.com/jmanero/vault-yubikey-helper/pkg/systemd"
 	"github.com/spf13/cobra"
+	"go.uber.org/multierr"
 	"go.uber.org/zap"
 )
 
+var unseal = cobra.Command{
+	Use:    "unseal FILE...",
+	Short:  "Decrypt unseal-keys and use them to unseal a vault instance",
+	PreRun: util.PinFromEnvironment,
+	RunE:   Unseal,
+	Args:   cobra.MinimumNArgs(1),
+
+	Long: `Decrypt unseal-keys and use them to unseal a vault instance.
+
+Failures exit with distinct codes for use with systemd restart policies:
+
+  3  No PIV device could decrypt the unseal-keys
+  4  A PIV device rejected the PIN
+  5  Vault did not respond before --wait expired
+  6  Vault is still sealed after submitting all decrypted unseal-keys
+
+With --systemd, progress is reported to the service manager with sd_notify, and
+READY=1 is sent once Vault is unsealed. The PIN is also read from the
+"yubikey-pin" credential of units with LoadCredential= in all modes.
+
+With --cluster, unseal-keys are decrypted once and used to unseal each --node
+concurrently, or each member of the Raft configuration of --vault-endpoint,
+after unsealing it. Discovery requires a root token in FILE, and an active
+leader. Without one, e.g. after a whole-cluster outage, the leader_api_addr of
+each raft retry_join stanza in --vault-config is unsealed instead.
+
+With --migrate, unseal-keys are submitted to a vault in seal migration mode, e.g.
+after an auto-unseal seal stanza is added to its configuration. Once migration
+is complete, the unseal-keys are Vault's recovery keys, and each FILE is
+re-encrypted for its recipients with its keys moved to recovery keys. The
+original file is copied to FILE.TIMESTAMP first. Files are not rewritten unless
+the migration is completed by this command, which waits up to --wait, or 2m.
+On an HA standby node, unseal returns once the node is unsealed, without
+waiting or rewriting files.`,
+}
+
+// Unseal options
+var (
+	UnsealSystemd     bool
+	UnsealWait        time.Duration
+	UnsealCluster     bool
+	UnsealNodes       []string
+	UnsealVaultConfig string
+	UnsealMigrate     bool
+)
+
 func init() {
-	CLI.AddCommand(&cobra.Command{
-		Use:    "unseal FILE",
-		Short:  "Decrypt an unseal-key and use it to unseal a vault instance",
-		PreRun: util.PinFromEnvironment,
-		RunE:   Unseal,
-		Args:   cobra.ExactArgs(1),
-	})
+	flags := unseal.PersistentFlags()
+	flags.BoolVar(&UnsealSystemd, "systemd", false, "Report status to systemd with sd_notify, for Type=notify units")
+	flags.DurationVar(&UnsealWait, "wait", 0, "Wait up to this long for the Vault listener to respond before unsealing")
+	flags.BoolVar(&UnsealCluster, "cluster", false, "Unseal every node of a cluster concurrently. Nodes are given with --node, or discovered from the Raft configuration of --vault-endpoint with the decrypted root token")
+	flags.BoolVar(&UnsealMigrate, "migrate", false, "Submit unseal-keys to a vault in seal migration mode, then rewrite FILE with them as recovery keys of the new auto-unseal seal")
+	flags.StringArrayVar(&UnsealNodes, "node", []string{}, "API address of a cluster node to unseal with --cluster. Repeat for each node")
+	flags.StringVar(&UnsealVaultConfig, "vault-config", "/etc/vault.d/vault.hcl", "Vault configuration file to read raft retry_join peers from with --cluster, if no leader is active for discovery")
+
+	CLI.AddCommand(&unseal)
 }
 
 // ErrSealed is returned by failed unseal operations
 var ErrSealed = errors.New("Vault has not been unsealed")
 
-// Unseal a Vault instance from an encrypted secrets file
-func Unseal(cmd *cobra.Command, args []string) (err error) {
-	vault, err := api.NewClient(&util.Vault)
-	if err != nil {
+// ErrUnreachable is returned if Vault does not respond within the --wait timeout
+var ErrUnreachable = errors.New("Vault did not respond")
+
+// notify reports status to systemd in --systemd mode
+func notify(states ...string) {
+	if !UnsealSystemd {
 		return
 	}
 
-	common.Logger.Info("Reading encrypted vault secrets", zap.String("path", args[0]))
-	encrypted, err := os.ReadFile(args[0])
-	if err != nil {
+	if err := systemd.Notify(states...); err != nil {
+		common.Logger.Warn("Unable to notify systemd", zap.Error(err))
+	}
+}
+
+// Unseal a Vault instance from encrypted secrets files. Files that can not be decrypted with an attached card are skipped
+func Unseal(cmd *cobra.Command, args []string) (err error) {
+	if UnsealMigrate {
+		if UnsealCluster {
+			return fmt.Errorf("%w: --migrate can not be combined with --cluster. Migrate each node in turn", util.ErrFlags)
+		}
+
+		err = migrateSeal(cmd, args)
+		if err == nil {
+			notify(systemd.Ready, systemd.Status("Vault unsealed for seal migration"))
+		}
+
 		return
 	}
 
-	var message api.InitResponse
-	_, err = envelope.Decrypt(encrypted, &message, util.Yubikey.Pin)
-	if err != nil {
+	if UnsealCluster {
+		err = unsealCluster(cmd, args)
+		if err == nil {
+			notify(systemd.Ready, systemd.Status("Cluster unsealed"))
+		}
+
 		return
 	}
 
-	common.Logger.Info("Unsealing vault", zap.String("endpoint", util.Vault.Address))
-	status, err := vault.Sys().Unseal(message.Keys[0])
+	if len(UnsealNodes) > 0 {
+		return fmt.Errorf("%w: --node requires --cluster", util.ErrFlags)
+	}
+
+	vault, err := api.NewClient(&util.Vault)
 	if err != nil {
 		return
 	}
 
-	if status.Sealed {
+	if UnsealWait > 0 {
+		notify(systemd.Status("Waiting for Vault listener"))
+
+		err = waitForVault(cmd.Context(), vault, UnsealWait)
+		if err != nil {
+			notify(systemd.Status("Vault did not respond"))
+			return util.Exit{Code: util.ExitVaultUnreachable, Err: err}
+		}
+	}
+
+	var status *api.SealStatusResponse
+	var errs error
+
+	for _, name := range args {
+		var message api.InitResponse
+
+		notify(systemd.Status("Decrypting " + name))
+		_, err1 := util.ReadEnvelope(name, &message)
+		if util.WrongPin(err1) {
+			// Each remaining file would use up another of the device's PIN retries
+			notify(systemd.Status("PIV device rejected the PIN"))
+			return util.Exit{Code: util.ExitWrongPin, Err: err1}
+		}
+
+		if err1 != nil {
+			common.Logger.Warn("Unable to decrypt vault secrets", zap.String("path", name), zap.Error(err1))
+			errs = multierr.Append(errs, err1)
+			continue
+		}
+
+		for _, key := range message.Keys {
+			common.Logger.Info("Unsealing vault", zap.String("endpoint", util.Vault.Address), zap.String("path", name))
+			notify(systemd.Status("Unsealing Vault"))
+
+			status, err = vault.Sys().UnsealWithContext(cmd.Context(), key)
+			if err != nil {
+				var rerr *api.ResponseError
+				if !errors.As(err, &rerr) {
+					err = util.Exit{Code: util.ExitVaultUnreachable, Err: err}
+				}
+
+				return
+			}
+
+			if !status.Sealed {
+				common.Logger.Info("Unseal successful", zap.String("version", status.Version), zap.String("cluster", status.ClusterName))
+				notify(systemd.Ready, systemd.Status("Vault unsealed"))
+				return
+			}
+		}
+	}
+
+	if status == nil && errs != nil {
+		// No unseal-keys could be decrypted
+		notify(systemd.Status("Unable to decrypt unseal-keys"))
+		return util.CardExit(errs)
+	}
+
+	if status != nil {
 		common.Logger.Warn("Unable to unseal vault", zap.Int("t", status.T), zap.Int("n", status.N), zap.Int("progress", status.Progress))
-		return ErrSealed
 	}
 
-	common.Logger.Info("Unseal successful", zap.String("version", status.Version), zap.String("cluster", status.ClusterName))
-	return
+	notify(systemd.Status("Vault is still sealed"))
+	return util.Exit{Code: util.ExitSealed, Err: ErrSealed}
+}
+
+// waitForVault polls Vault's seal status until it responds, or the timeout expires
+func waitForVault(ctx context.Context, vault *api.Client, timeout time.Duration) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		_, err = vault.Sys().SealStatusWithContext(ctx)
+		if err == nil {
+			return
+		}
+
+		common.Logger.Info("Waiting for vault listener", zap.String("endpoint", util.Vault.Address), zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w within %s: %w", ErrUnreachable, timeout, err)
+		case <-time.After(time.Second):
+		}
+	}
 }
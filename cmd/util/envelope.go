@@ -0,0 +1,536 @@
+package util
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/hashicorp/vault/api"
+	"github.com/jmanero/vault-yubikey-helper/pkg/common"
+	"github.com/jmanero/vault-yubikey-helper/pkg/envelope"
+	"github.com/jmanero/vault-yubikey-helper/pkg/pgp"
+	"github.com/jmanero/vault-yubikey-helper/pkg/piv"
+	"go.uber.org/zap"
+	"golang.org/x/term"
+	"pault.ag/go/ykpiv"
+)
+
+// Cards returns options to open each of the PIV devices selected with --serial flags
+func Cards() (cards []piv.Options) {
+	for _, serial := range Serials {
+		opts := Yubikey.Copy()
+		opts.Serial = uint32(serial)
+
+		cards = append(cards, opts)
+	}
+
+	return
+}
+
+// CheckQuorum validates --quorum against the number of --serial PIV devices and --to-recipient keys, so that
+// invalid flags are reported before any PIV device or PIN is used. Without either, one PIV device is selected
+func CheckQuorum() error {
+	if Quorum == 0 {
+		return nil
+	}
+
+	n := len(Serials) + len(RecipientFiles)
+	if n == 0 {
+		n = 1
+	}
+
+	if Quorum < 2 || Quorum > n {
+		return fmt.Errorf("%w: --quorum %d must be at least 2, and at most the %d --serial PIV devices and --to-recipient keys", ErrFlags, Quorum, n)
+	}
+
+	return nil
+}
+
+// ReadRecipients loads public-keys from --to-recipient files. RSA keys must have been exported from a
+// PIV device with a serial, whose RSA slots can only decrypt PKCS1v15, unless --software-rsa is set
+func ReadRecipients() (recipients []envelope.Recipient, err error) {
+	keys, err := readRecipientFiles()
+	if err != nil {
+		return
+	}
+
+	for i, key := range keys {
+		if _, is := key.PublicKey.(*rsa.PublicKey); is && !key.PIV && !SoftwareRSA {
+			return nil, fmt.Errorf("%w: %s. Export it with export-recipient, or set --software-rsa if it is not held by a PIV device", ErrRSARecipient, RecipientFiles[i])
+		}
+
+		recipients = append(recipients, key)
+	}
+
+	return
+}
+
+// readRecipientFiles parses the --to-recipient files
+func readRecipientFiles() (recipients []envelope.KeyRecipient, err error) {
+	for _, name := range RecipientFiles {
+		common.Logger.Info("Reading recipient public-key", zap.String("path", name))
+
+		var data []byte
+		data, err = os.ReadFile(name)
+		if err != nil {
+			return
+		}
+
+		var recipient envelope.KeyRecipient
+		recipient, err = envelope.ParseRecipient(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+
+		recipients = append(recipients, recipient)
+	}
+
+	return
+}
+
+// passphrase caches the --recovery-passphrase for commands that both decrypt and encrypt with it
+var passphrase []byte
+
+// Passphrase reads the --recovery-passphrase from the VAULT_RECOVERY_PASSPHRASE environment variable,
+// or prompts for it on the terminal. New passphrases must be entered twice
+func Passphrase(confirm bool) (_ []byte, err error) {
+	if passphrase != nil {
+		return passphrase, nil
+	}
+
+	if value, has := os.LookupEnv("VAULT_RECOVERY_PASSPHRASE"); has && len(value) > 0 {
+		common.Logger.Info("Using recovery passphrase from environment variable VAULT_RECOVERY_PASSPHRASE")
+		passphrase = []byte(value)
+		return passphrase, nil
+	}
+
+	value, err := askPassphrase("Recovery Passphrase")
+	if err != nil {
+		return
+	}
+
+	if confirm {
+		var again []byte
+
+		again, err = askPassphrase("Confirm Recovery Passphrase")
+		if err != nil {
+			return
+		}
+
+		if !bytes.Equal(value, again) {
+			return nil, fmt.Errorf("%w: recovery passphrases do not match", ErrFlags)
+		}
+	}
+
+	passphrase = value
+	return passphrase, nil
+}
+
+// askPassphrase prompts for a passphrase without displaying it on terminals
+func askPassphrase(prompt string) (value []byte, err error) {
+	fmt.Fprintf(os.Stderr, "%s:  [🔒] ", prompt)
+	value, err = term.ReadPassword(int(syscall.Stdin))
+	fmt.Fprintln(os.Stderr)
+
+	if err == nil && len(value) == 0 {
+		err = fmt.Errorf("%w: empty recovery passphrase", ErrFlags)
+	}
+
+	return
+}
+
+// Recovery returns a passphrase recipient if --recovery-passphrase is set
+func Recovery() (recipients []envelope.Recipient, err error) {
+	if !RecoveryPassphrase {
+		return
+	}
+
+	passphrase, err := Passphrase(true)
+	if err != nil {
+		return
+	}
+
+	return []envelope.Recipient{envelope.PassphraseRecipient{Passphrase: passphrase}}, nil
+}
+
+// Recipients returns recipients for --to-recipient files and the PIV devices selected with
+// --serial flags. If neither are given, the first attached PIV device that is not avoided is used.
+// A --recovery-passphrase recipient is added alongside the others
+func Recipients(avoid ...uint) (recipients []envelope.Recipient, err error) {
+	err = CheckQuorum()
+	if err != nil {
+		return
+	}
+
+	recipients, err = ReadRecipients()
+	if err != nil {
+		return
+	}
+
+	cards := Cards()
+	if len(cards) == 0 && len(recipients) == 0 {
+		opts := Yubikey.Copy()
+		opts.Avoid = append(opts.Avoid, avoid...)
+
+		cards = append(cards, opts)
+	}
+
+	for _, opts := range cards {
+		var recipient envelope.KeyRecipient
+
+		recipient, err = envelope.PIVRecipient(opts)
+		if err != nil {
+			return
+		}
+
+		recipients = append(recipients, recipient)
+	}
+
+	recovery, err := Recovery()
+	if err != nil {
+		return
+	}
+
+	return append(recipients, recovery...), nil
+}
+
+// SelectRecipients returns the given number of distinct recipients from --to-recipient files and
+// --serial flags, or auto-selects PIV devices for any recipients that are not given by --to-recipient
+func SelectRecipients(count int) (recipients []envelope.Recipient, err error) {
+	recipients, err = ReadRecipients()
+	if err != nil {
+		return
+	}
+
+	cards := Cards()
+	if len(cards) == 0 && len(recipients) < count {
+		cards, err = piv.Select(Yubikey.WithSlot(ykpiv.KeyManagement), count-len(recipients))
+		if err != nil {
+			return
+		}
+	}
+
+	if len(recipients)+len(cards) != count {
+		return nil, fmt.Errorf("%w: %d --to-recipient and %d --serial flags given for %d recipients", ErrFlags, len(recipients), len(cards), count)
+	}
+
+	for _, opts := range cards {
+		var recipient envelope.KeyRecipient
+
+		recipient, err = envelope.PIVRecipient(opts)
+		if err != nil {
+			return
+		}
+
+		recipients = append(recipients, recipient)
+	}
+
+	return
+}
+
+// Identities returns identities for --identity files and the --recovery-passphrase, followed by attached PIV devices
+func Identities() (identities []envelope.Identity, err error) {
+	for _, name := range IdentityFiles {
+		common.Logger.Info("Reading identity private key", zap.String("path", name))
+
+		var data []byte
+		data, err = os.ReadFile(name)
+		if err != nil {
+			return
+		}
+
+		var identity envelope.KeyIdentity
+		identity, err = envelope.ParseIdentity(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+
+		identities = append(identities, identity)
+	}
+
+	if RecoveryPassphrase {
+		var passphrase []byte
+
+		passphrase, err = Passphrase(false)
+		if err != nil {
+			return
+		}
+
+		identities = append(identities, envelope.PassphraseIdentity{Passphrase: passphrase})
+	}
+
+	return append(identities, envelope.PIVIdentity{Options: Yubikey.Copy()}), nil
+}
+
+// StanzaRecipients resolves the recipients of an envelope's stanzas, to re-encrypt it for the same recipients.
+// Software keys are matched by fingerprint with --identity and --to-recipient keys, passphrase stanzas use the
+// --recovery-passphrase, and PIV devices are opened by serial, and must still hold the stanza's key
+func StanzaRecipients(stanzas []envelope.Stanza, identities []envelope.Identity) (recipients []envelope.Recipient, err error) {
+	// Index software keys by both their current and legacy fingerprints
+	keys := make(map[string]envelope.KeyRecipient)
+
+	files, err := readRecipientFiles()
+	if err != nil {
+		return
+	}
+
+	for _, identity := range identities {
+		if key, is := identity.(envelope.KeyIdentity); is {
+			files = append(files, envelope.KeyRecipient{PublicKey: key.Key.Public()})
+		}
+	}
+
+	for _, key := range files {
+		keys[common.FingerprintSPKI(key.PublicKey)] = key
+		keys[common.FingerprintKey(key.PublicKey)] = key
+	}
+
+	for _, stanza := range stanzas {
+		if key, has := keys[stanza.KeyID]; has {
+			// Wrap for the key as it was before, i.e. for a PIV device if the stanza has its serial
+			key.PIV = stanza.Device > 0
+			recipients = append(recipients, key)
+			continue
+		}
+
+		if stanza.Algorithm == envelope.SchemeScrypt {
+			var recovery []envelope.Recipient
+
+			recovery, err = Recovery()
+			if err != nil {
+				return
+			}
+
+			if len(recovery) == 0 {
+				return nil, fmt.Errorf("%w: --recovery-passphrase is required for its passphrase recipient", envelope.ErrNoMatch)
+			}
+
+			recipients = append(recipients, recovery...)
+			continue
+		}
+
+		if stanza.Device == 0 {
+			return nil, fmt.Errorf("%w: no --identity or --to-recipient file for recipient %s", envelope.ErrNoMatch, stanza.KeyID)
+		}
+
+		opts := Yubikey.Copy()
+		opts.Serial = stanza.Device
+
+		var recipient envelope.KeyRecipient
+		recipient, err = envelope.PIVRecipient(opts)
+		if err != nil {
+			return
+		}
+
+		// The device's key-management slot may have been re-provisioned since the envelope was written
+		if !common.MatchFingerprint(recipient.PublicKey, stanza.KeyID) {
+			return nil, fmt.Errorf("%w: PIV device %d holds %s, not recipient %s", envelope.ErrKeyMismatch, stanza.Device, common.FingerprintSPKI(recipient.PublicKey), stanza.KeyID)
+		}
+
+		recipients = append(recipients, recipient)
+	}
+
+	return
+}
+
+// ShareFile inserts a share's index before the extension of a file name
+func ShareFile(name string, index int) string {
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s.%d%s", strings.TrimSuffix(name, ext), index, ext)
+}
+
+// ReadSecrets decrypts and merges the unseal-keys and recovery keys of each of the given files, and the
+// first root token found in any of them. Files that can not be decrypted are skipped, unless a PIV
+// device rejects the PIN
+func ReadSecrets(names []string) (message api.InitResponse, err error) {
+	seen := make(map[string]struct{})
+
+	merge := func(keys, encoded []string, into, intoB64 *[]string) {
+		for i, key := range keys {
+			if _, has := seen[key]; has {
+				continue
+			}
+
+			seen[key] = struct{}{}
+			*into = append(*into, key)
+
+			if i < len(encoded) {
+				*intoB64 = append(*intoB64, encoded[i])
+			}
+		}
+	}
+
+	for _, name := range names {
+		var secrets api.InitResponse
+
+		_, err1 := ReadEnvelope(name, &secrets)
+		if WrongPin(err1) {
+			// Don't use up the PIN retries of the device with the remaining files
+			return message, err1
+		}
+
+		if err1 != nil {
+			common.Logger.Warn("Unable to decrypt vault secrets", zap.String("path", name), zap.Error(err1))
+			continue
+		}
+
+		merge(secrets.Keys, secrets.KeysB64, &message.Keys, &message.KeysB64)
+		merge(secrets.RecoveryKeys, secrets.RecoveryKeysB64, &message.RecoveryKeys, &message.RecoveryKeysB64)
+
+		if len(message.RootToken) == 0 {
+			message.RootToken = secrets.RootToken
+		}
+	}
+
+	if len(message.Keys) == 0 && len(message.RecoveryKeys) == 0 {
+		return message, fmt.Errorf("%w: unable to decrypt any unseal-keys or recovery keys", envelope.ErrNoMatch)
+	}
+
+	return
+}
+
+// OperationKeys returns the keys that authorize operations like generate-root and rekey: recovery keys
+// if Vault uses an auto-unseal seal, or unseal-keys otherwise
+func OperationKeys(message api.InitResponse, status *api.SealStatusResponse) ([]string, error) {
+	if status.RecoverySeal {
+		if len(message.RecoveryKeys) == 0 {
+			return nil, fmt.Errorf("%w: Vault uses a %s seal, which requires recovery keys", ErrNoRecoveryKeys, status.Type)
+		}
+
+		return message.RecoveryKeys, nil
+	}
+
+	if len(message.Keys) == 0 {
+		return nil, fmt.Errorf("%w: Vault uses a %s seal, which requires unseal-keys", ErrNoUnsealKeys, status.Type)
+	}
+
+	return message.Keys, nil
+}
+
+// RootFile inserts "root" before the extension of a file name, for the root token file of a split init
+func RootFile(name string) string {
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s.root%s", strings.TrimSuffix(name, ext), ext)
+}
+
+// ReadEnvelope decrypts a value from an encrypted file
+func ReadEnvelope(name string, value any) (opened []envelope.Stanza, err error) {
+	identities, err := Identities()
+	if err != nil {
+		return
+	}
+
+	common.Logger.Info("Reading encrypted vault secrets", zap.String("path", name))
+	encrypted, err := os.ReadFile(name)
+	if err != nil {
+		return
+	}
+
+	return envelope.Decrypt(encrypted, value, identities...)
+}
+
+// WriteEnvelope encrypts a value for the given recipients and writes it to a file, with an OpenPGP escrow copy for any --pgp-key flags.
+// A threshold above zero splits the data-key between the recipients, like --quorum
+func WriteEnvelope(name string, value any, threshold int, recipients []envelope.Recipient) (err error) {
+	encrypted, err := Encrypt(value, threshold, recipients)
+	if err != nil {
+		return
+	}
+
+	common.Logger.Info("Writing encrypted vault secrets", zap.String("path", name))
+	err = common.WriteAtomic(name, encrypted, 0600)
+	if err != nil {
+		return
+	}
+
+	return WriteEscrow(name, value)
+}
+
+// Seal encrypts raw data for the given recipients, splitting its data-key between them if a --quorum is set
+func Seal(data []byte, recipients []envelope.Recipient) ([]byte, error) {
+	return envelope.Seal(data, Quorum, recipients...)
+}
+
+// Encrypt a value for the given recipients, splitting its data-key between them if threshold is above zero
+func Encrypt(value any, threshold int, recipients []envelope.Recipient) ([]byte, error) {
+	return envelope.EncryptThreshold(value, threshold, recipients...)
+}
+
+// EscrowKeys reads the --pgp-key public keys. Keys are checked by encrypting a test message for them
+func EscrowKeys() (keys openpgp.EntityList, err error) {
+	for _, file := range PGPKeyFiles {
+		common.Logger.Info("Reading OpenPGP public key", zap.String("path", file))
+
+		var data []byte
+		data, err = os.ReadFile(file)
+		if err != nil {
+			return
+		}
+
+		var parsed openpgp.EntityList
+		parsed, err = pgp.ParseKeys(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+
+		keys = append(keys, parsed...)
+	}
+
+	if len(keys) > 0 {
+		_, err = pgp.Encrypt([]byte("check"), keys)
+	}
+
+	return
+}
+
+// WriteEscrow writes a copy of a value encrypted for the --pgp-key public keys to FILE.asc, if any are given
+func WriteEscrow(name string, value any) (err error) {
+	if len(PGPKeyFiles) == 0 {
+		return
+	}
+
+	keys, err := EscrowKeys()
+	if err != nil {
+		return
+	}
+
+	data, err := common.MarshalJSON(value)
+	if err != nil {
+		return
+	}
+
+	encrypted, err := pgp.Encrypt(data, keys)
+	if err != nil {
+		return
+	}
+
+	name += ".asc"
+
+	common.Logger.Info("Writing OpenPGP encrypted escrow copy", zap.String("path", name), zap.Int("keys", len(keys)))
+	return common.WriteAtomic(name, encrypted, 0600)
+}
+
+// Backup copies a file to FILE.TIMESTAMP before it is replaced. It returns an empty name if the file does not exist
+func Backup(name string) (backup string, err error) {
+	data, err := os.ReadFile(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+
+	if err != nil {
+		return
+	}
+
+	backup = name + "." + time.Now().UTC().Format("20060102T150405Z")
+
+	common.Logger.Info("Writing backup of original file", zap.String("path", backup))
+	return backup, common.WriteAtomic(backup, data, 0600)
+}
@@ -1,27 +1,84 @@
 package util
 
 import (
+	"errors"
 	"os"
+	"strings"
 
 	"github.com/hashicorp/vault/api"
 	"github.com/jmanero/vault-yubikey-helper/pkg/common"
+	"github.com/jmanero/vault-yubikey-helper/pkg/envelope"
 	"github.com/jmanero/vault-yubikey-helper/pkg/piv"
+	"github.com/jmanero/vault-yubikey-helper/pkg/systemd"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+	"pault.ag/go/ykpiv"
+)
+
+// Errors
+var (
+	ErrFlags       = errors.New("Invalid flags")
+	ErrNoRootToken = errors.New("Encrypted file does not contain a root token")
+
+	ErrRSARecipient = errors.New("RSA recipient file has no PIV device serial")
+
+	ErrNoUnsealKeys   = errors.New("Encrypted files do not contain unseal-keys")
+	ErrNoRecoveryKeys = errors.New("Encrypted files do not contain recovery keys")
 )
 
 // Global configuration registers shared by subcommand packages
 var (
 	Vault   api.Config
 	Yubikey piv.Options
+	Serials []uint
+	Quorum  int
+
+	RecipientFiles     []string
+	SoftwareRSA        bool
+	IdentityFiles      []string
+	RecoveryPassphrase bool
+	PGPKeyFiles        []string
 )
 
-// PinFromEnvironment is a PreRun hook to set the Yubikey PIN for the command from an environment variable
+// RecipientFlags registers flags for the recipients of envelopes written by Recipients and SelectRecipients
+func RecipientFlags(flags *pflag.FlagSet) {
+	flags.StringArrayVar(&RecipientFiles, "to-recipient", []string{}, "Encrypt for a PEM encoded public-key or certificate file in addition to any --serial PIV devices")
+	flags.BoolVar(&SoftwareRSA, "software-rsa", false, "Allow RSA --to-recipient keys without a Serial line, and wrap data-keys for them with RSA-OAEP. PIV devices can not decrypt RSA-OAEP")
+	flags.IntVar(&Quorum, "quorum", 0, "Require this many of the --serial PIV devices and --to-recipient keys to decrypt each envelope. By default, any one of them can decrypt it")
+}
+
+// EscrowFlags registers flags for the OpenPGP escrow copies written by WriteEscrow
+func EscrowFlags(flags *pflag.FlagSet) {
+	flags.StringArrayVar(&PGPKeyFiles, "pgp-key", []string{}, "Also write a copy of each encrypted file's secrets to FILE.asc, encrypted for an OpenPGP public key file. Repeat to allow any of several keys to decrypt it")
+}
+
+// SelectSerial is a PersistentPreRun hook to select a single PIV device from the first --serial flag value
+func SelectSerial(cmd *cobra.Command, _ []string) {
+	if len(Serials) > 0 {
+		Yubikey.Serial = uint32(Serials[0])
+	}
+}
+
+// PinCredential names the systemd credential that PinFromEnvironment reads the Yubikey PIN from
+const PinCredential = "yubikey-pin"
+
+// PinFromEnvironment is a PreRun hook to set the Yubikey PIN for the command from a systemd credential
+// in $CREDENTIALS_DIRECTORY, or an environment variable
 func PinFromEnvironment(cmd *cobra.Command, _ []string) {
 	if cmd.Flag("pin").Changed {
 		// Use pin explicitly set by the command flag
 		return
 	}
 
+	if value, has, err := systemd.Credential(PinCredential); err != nil {
+		common.Logger.Warn("Unable to read yubikey pin from systemd credential", zap.String("name", PinCredential), zap.Error(err))
+	} else if has {
+		common.Logger.Info("Using yubikey pin from systemd credential", zap.String("name", PinCredential))
+		Yubikey.Pin = strings.TrimSpace(string(value))
+		return
+	}
+
 	if value, has := os.LookupEnv("YUBIKEY_PIN"); has && len(value) > 0 {
 		common.Logger.Info("Using yubikey pin from environment variable YUBIKEY_PIN")
 		Yubikey.Pin = value
@@ -32,3 +89,55 @@ func PinFromEnvironment(cmd *cobra.Command, _ []string) {
 type ExitError interface {
 	ExitCode() int
 }
+
+// Exit codes for errors that services may handle differently, e.g. with RestartPreventExitStatus=
+const (
+	ExitCardMissing      = 3
+	ExitWrongPin         = 4
+	ExitVaultUnreachable = 5
+	ExitSealed           = 6
+)
+
+// Exit wraps an error with a process exit code
+type Exit struct {
+	Code int
+	Err  error
+}
+
+func (err Exit) Error() string {
+	return err.Err.Error()
+}
+
+// Unwrap returns the wrapped error
+func (err Exit) Unwrap() error {
+	return err.Err
+}
+
+// ExitCode returns the process exit code for the error
+func (err Exit) ExitCode() int {
+	return err.Code
+}
+
+// WrongPin reports whether a PIV device rejected the PIN, or has locked it. Operations must not be
+// retried with the same PIN, as each attempt uses up one of the device's PIN retries
+func WrongPin(err error) bool {
+	if errors.Is(err, envelope.ErrPIN) {
+		return true
+	}
+
+	var yerr ykpiv.Error
+	return errors.As(err, &yerr) && (ykpiv.WrongPIN.Equal(yerr) || ykpiv.PINLockedError.Equal(yerr) || ykpiv.AuthBlocked.Equal(yerr))
+}
+
+// CardExit assigns exit codes to errors from PIV devices that were missing or rejected a PIN
+func CardExit(err error) error {
+	if WrongPin(err) {
+		return Exit{Code: ExitWrongPin, Err: err}
+	}
+
+	if errors.Is(err, piv.ErrNoCards) || errors.Is(err, piv.ErrNoMatch) {
+		return Exit{Code: ExitCardMissing, Err: err}
+	}
+
+	return err
+}
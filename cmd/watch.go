@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/jmanero/vault-yubikey-helper/cmd/util"
+	"github.com/jmanero/vault-yubikey-helper/pkg/common"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var watch = cobra.Command{
+	Use:    "watch FILE...",
+	Short:  "Poll a vault instance's seal status, and unseal it with decrypted unseal-keys whenever it is sealed",
+	PreRun: util.PinFromEnvironment,
+	RunE:   Watch,
+	Args:   cobra.MinimumNArgs(1),
+
+	Long: `Poll a vault instance's seal status, and unseal it with decrypted unseal-keys whenever it is sealed.
+
+Errors, e.g. while Vault is restarting or a PIV device is removed, are logged and
+retried with exponential backoff up to --max-backoff. The command runs until it
+receives SIGTERM, or a PIV device rejects the PIN: it then exits with code 4
+instead of retrying, which would lock the device's PIN.
+
+By default, unseal-keys are decrypted each time Vault is sealed. With a positive
+--cache-ttl, decrypted keys are kept in memory for up to that long.`,
+}
+
+// Watch options
+var (
+	WatchInterval   time.Duration
+	WatchMaxBackoff time.Duration
+	WatchCacheTTL   time.Duration
+)
+
+func init() {
+	flags := watch.PersistentFlags()
+	flags.DurationVar(&WatchInterval, "interval", 10*time.Second, "Time between seal status checks")
+	flags.DurationVar(&WatchMaxBackoff, "max-backoff", 5*time.Minute, "Maximum time between retries after errors")
+	flags.DurationVar(&WatchCacheTTL, "cache-ttl", 0, "Keep decrypted unseal-keys in memory for up to this long. By default, keys are decrypted each time Vault is sealed")
+
+	CLI.AddCommand(&watch)
+}
+
+// keyCache holds decrypted unseal-keys until they expire
+type keyCache struct {
+	keys    []string
+	expires time.Time
+}
+
+// get returns cached keys, or decrypts them from the given files
+func (cache *keyCache) get(names []string) (keys []string, err error) {
+	if len(cache.keys) > 0 && time.Now().Before(cache.expires) {
+		return cache.keys, nil
+	}
+
+	cache.clear()
+
+	message, err := util.ReadSecrets(names)
+	if err != nil {
+		return
+	}
+
+	if WatchCacheTTL > 0 {
+		cache.keys = message.Keys
+		cache.expires = time.Now().Add(WatchCacheTTL)
+	}
+
+	return message.Keys, nil
+}
+
+// clear drops cached keys
+func (cache *keyCache) clear() {
+	cache.keys = nil
+	cache.expires = time.Time{}
+}
+
+// Watch polls Vault's seal status and unseals it until the command's context is canceled
+func Watch(cmd *cobra.Command, args []string) (err error) {
+	vault, err := api.NewClient(&util.Vault)
+	if err != nil {
+		return
+	}
+
+	ctx := cmd.Context()
+	wait := WatchInterval
+
+	var cache keyCache
+	for {
+		err = watchOnce(ctx, vault, args, &cache)
+
+		switch {
+		case err == nil:
+			wait = WatchInterval
+
+		case ctx.Err() != nil:
+			// Errors are expected from canceled requests
+
+		case util.WrongPin(err):
+			// Retrying would lock the PIV device's PIN
+			common.Logger.Error("PIV device rejected the PIN. Stopping seal status watch", zap.Error(err))
+			return util.Exit{Code: util.ExitWrongPin, Err: err}
+
+		default:
+			wait *= 2
+			if wait > WatchMaxBackoff {
+				wait = WatchMaxBackoff
+			}
+
+			common.Logger.Warn("Unable to check or unseal vault", zap.String("endpoint", util.Vault.Address), zap.Duration("retry", wait), zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			common.Logger.Info("Stopping seal status watch")
+			return nil
+		case <-time.After(wait):
+		}
+	}
+}
+
+// watchOnce checks Vault's seal status, and unseals it if needed
+func watchOnce(ctx context.Context, vault *api.Client, names []string, cache *keyCache) (err error) {
+	status, err := vault.Sys().SealStatusWithContext(ctx)
+	if err != nil {
+		return
+	}
+
+	if !status.Sealed {
+		return
+	}
+
+	common.Logger.Info("Vault is sealed", zap.String("endpoint", util.Vault.Address), zap.Int("t", status.T), zap.Int("progress", status.Progress))
+	keys, err := cache.get(names)
+	if err != nil {
+		return
+	}
+
+	for _, key := range keys {
+		status, err = vault.Sys().UnsealWithContext(ctx, key)
+		if err != nil {
+			// Cached keys may have been replaced, e.g. by a rekey
+			cache.clear()
+			return
+		}
+
+		if !status.Sealed {
+			common.Logger.Info("Unseal successful", zap.String("version", status.Version), zap.String("cluster", status.ClusterName))
+			return
+		}
+	}
+
+	cache.clear()
+	return fmt.Errorf("%w: progress %d of %d", ErrSealed, status.Progress, status.T)
+}
@@ -6,6 +6,8 @@ import (
 	"crypto/ecdsa"
 	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/fs"
@@ -18,10 +20,10 @@ import (
 	"go.uber.org/zap/zapcore"
 )
 
-// Logger for the utility
+// Logger for the utility. It writes to STDERR, leaving STDOUT for the output of commands like decrypt
 var Logger = zap.New(zapcore.NewCore(
 	zapcore.NewConsoleEncoder(zap.NewProductionEncoderConfig()),
-	zapcore.AddSync(os.Stdout),
+	zapcore.AddSync(os.Stderr),
 	zap.NewAtomicLevel(),
 ))
 
@@ -31,7 +33,25 @@ func init() {
 	randsrc = rand.NewSource(time.Now().Unix())
 }
 
-// FingerprintKey is a helper to generate string identifiers for crypto.PublicKey types
+// FingerprintSPKI returns the SHA-256 digest of a public-key's DER encoded SubjectPublicKeyInfo, matching
+// the output of `openssl pkey -pubin -outform DER | openssl dgst -sha256`
+func FingerprintSPKI(key crypto.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return fmt.Sprintf("Unsupported Key: %T<%v>", key, key)
+	}
+
+	sum := sha256.Sum256(der)
+	return "SHA256:" + hex.EncodeToString(sum[:])
+}
+
+// MatchFingerprint checks if a key ID is either the SPKI or legacy fingerprint of a public-key
+func MatchFingerprint(key crypto.PublicKey, kid string) bool {
+	return kid == FingerprintSPKI(key) || kid == FingerprintKey(key)
+}
+
+// FingerprintKey is a helper to generate legacy string identifiers for crypto.PublicKey types. Its
+// coordinates are not padded to a fixed width, so new identifiers should use FingerprintSPKI
 func FingerprintKey(key crypto.PublicKey) string {
 	hasher := sha256.New()
 
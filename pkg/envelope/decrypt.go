@@ -3,64 +3,170 @@ package envelope
 import (
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/ecdsa"
-	"crypto/rsa"
 	"encoding/json"
+	"errors"
 	"fmt"
 
 	"github.com/jmanero/vault-yubikey-helper/pkg/common"
-	"github.com/jmanero/vault-yubikey-helper/pkg/piv"
+	"github.com/jmanero/vault-yubikey-helper/pkg/shamir"
+	"go.uber.org/multierr"
 	"go.uber.org/zap"
-	"pault.ag/go/ykpiv"
 )
 
+// Errors
+var (
+	ErrNoMatch  = errors.New("Unable to decrypt the message with any of its recipients")
+	ErrNoQuorum = errors.New("Unable to decrypt enough of the message's recipients to meet its threshold")
+)
+
+// TamperError is returned if an envelope's cipher-text or authenticated header fields fail verification
+type TamperError struct {
+	Version int
+	Err     error
+}
+
+func (err TamperError) Error() string {
+	if err.Version < VersionAuthenticated {
+		return fmt.Sprintf("Envelope cipher-text failed authentication (version %d): %s", err.Version, err.Err)
+	}
+
+	return fmt.Sprintf("Envelope header or cipher-text failed authentication (version %d): %s", err.Version, err.Err)
+}
+
+// Unwrap returns the cipher's error
+func (err TamperError) Unwrap() error {
+	return err.Err
+}
+
 // Reader decodes an envelope message
 type Reader struct {
-	Device    uint32          `json:"dev"`
-	KeyID     string          `json:"kid"`
-	Metadata  json.RawMessage `json:"meta"`
-	Nonce     B64             `json:"nonce"`
-	Encrypted B64             `json:"enc"`
+	// Single-recipient fields of legacy envelopes
+	Device   uint32          `json:"dev"`
+	KeyID    string          `json:"kid"`
+	Metadata json.RawMessage `json:"meta"`
+
+	Version    int      `json:"v"`
+	Algorithm  string   `json:"alg"`
+	Threshold  int      `json:"t"`
+	Recipients []Stanza `json:"rcpt"`
+	Nonce      B64      `json:"nonce"`
+	Encrypted  B64      `json:"enc"`
 }
 
-// Decrypt an object from the given encrypted envelope
-func Decrypt(payload []byte, value any, pin string) (envelope Reader, err error) {
+// Parse an envelope, inferring algorithm identifiers for legacy envelopes
+func Parse(payload []byte) (envelope Reader, err error) {
 	err = json.Unmarshal(payload, &envelope)
 	if err != nil {
 		return
 	}
 
-	token, err := piv.Open(piv.Options{Serial: envelope.Device, Slot: &ykpiv.KeyManagement, Pin: pin})
-	if err != nil {
-		return
+	if envelope.Version > Version {
+		return envelope, fmt.Errorf("%w: %d", ErrUnsupportedVersion, envelope.Version)
 	}
-	defer token.Close()
 
-	err = token.Login()
+	if envelope.Version == VersionLegacy {
+		envelope.Algorithm = AlgorithmAESGCM
+
+		if len(envelope.Recipients) == 0 && len(envelope.KeyID) > 0 {
+			envelope.Recipients = []Stanza{{Device: envelope.Device, KeyID: envelope.KeyID, Metadata: envelope.Metadata}}
+		}
+
+		for i, stanza := range envelope.Recipients {
+			if len(stanza.Algorithm) == 0 {
+				envelope.Recipients[i].Algorithm = legacyScheme(stanza.KeyID)
+			}
+		}
+	}
+
+	if envelope.Algorithm != AlgorithmAESGCM {
+		return envelope, fmt.Errorf("%w: %q", ErrUnsupportedAlgorithm, envelope.Algorithm)
+	}
+
+	return
+}
+
+// Decrypt an object from the given encrypted envelope with the identities that
+// match its recipients, returning the stanzas that were used to recover its data-key
+func Decrypt(payload []byte, value any, identities ...Identity) (opened []Stanza, err error) {
+	data, opened, err := Open(payload, identities...)
 	if err != nil {
 		return
 	}
 
-	slot, err := token.KeyManagement()
+	err = json.Unmarshal(data, value)
+	return
+}
+
+// Open decrypts raw data from the given encrypted envelope, like Decrypt
+func Open(payload []byte, identities ...Identity) (data []byte, opened []Stanza, err error) {
+	envelope, err := Parse(payload)
 	if err != nil {
 		return
 	}
 
-	var secret []byte
+	data, _, opened, err = envelope.open(identities)
+	return
+}
 
-	fingerprint := common.FingerprintKey(slot.PublicKey)
-	if envelope.KeyID != fingerprint {
-		return envelope, fmt.Errorf("%w: %s != %s", ErrKeyMismatch, envelope.KeyID, fingerprint)
+// open recovers the envelope's data-key with the given identities and decrypts its payload
+func (envelope Reader) open(identities []Identity) (data, secret []byte, opened []Stanza, err error) {
+	// Threshold envelopes require a share from each of Threshold recipients
+	need := 1
+	if envelope.Threshold > 0 {
+		need = envelope.Threshold
 	}
 
-	switch slot.PublicKey.(type) {
-	case *ecdsa.PublicKey:
-		common.Logger.Info("Decrypting with ECDH/AES", zap.String("key_id", envelope.KeyID))
-		secret, err = DecryptEC(slot, envelope)
+	var shares [][]byte
+	var errs error
+
+	for _, stanza := range envelope.Recipients {
+		share, err1 := unwrap(stanza, identities)
+		if errors.Is(err1, ErrPIN) {
+			return nil, nil, opened, err1
+		}
+
+		if err1 != nil {
+			common.Logger.Warn("Unable to decrypt with recipient", zap.Uint32("serial", stanza.Device), zap.String("key_id", stanza.KeyID), zap.Error(err1))
+			errs = multierr.Append(errs, err1)
+			continue
+		}
+
+		opened = append(opened, stanza)
+
+		// Passphrase stanzas of threshold envelopes hold the whole data-key
+		if envelope.Threshold > 0 && stanza.Algorithm == SchemeScrypt {
+			common.Logger.Info("Recovered data-key with passphrase", zap.Int("t", need))
+			secret = share
+			break
+		}
 
-	case *rsa.PublicKey:
-		common.Logger.Info("Decrypting with RSA+PKCS1v15/AES", zap.String("key_id", envelope.KeyID))
-		secret, err = DecryptRSA(slot, envelope)
+		shares = append(shares, share)
+
+		if len(shares) == need {
+			break
+		}
+	}
+
+	switch {
+	case secret != nil:
+		// Recovered with a passphrase stanza
+
+	case len(shares) == 0:
+		return nil, nil, opened, multierr.Append(ErrNoMatch, errs)
+
+	case len(shares) < need:
+		common.Logger.Warn("Unable to meet envelope threshold", zap.Int("t", need), zap.Int("opened", len(shares)))
+		return nil, nil, opened, multierr.Append(fmt.Errorf("%w: %d of %d", ErrNoQuorum, len(shares), need), errs)
+
+	case envelope.Threshold > 0:
+		common.Logger.Info("Combining data-key shares", zap.Int("t", need))
+		secret, err = shamir.Combine(shares)
+		if err != nil {
+			return
+		}
+
+	default:
+		secret = shares[0]
 	}
 
 	block, err := aes.NewCipher(secret)
@@ -73,11 +179,35 @@ func Decrypt(payload []byte, value any, pin string) (envelope Reader, err error)
 		return
 	}
 
-	data, err := aead.Open(nil, envelope.Nonce, envelope.Encrypted, nil)
+	ad, err := AdditionalData(envelope.Version, envelope.Algorithm, envelope.Threshold, envelope.Recipients)
 	if err != nil {
 		return
 	}
 
-	err = json.Unmarshal(data, value)
+	data, err = aead.Open(nil, envelope.Nonce, envelope.Encrypted, ad)
+	if err != nil {
+		return nil, nil, opened, TamperError{Version: envelope.Version, Err: err}
+	}
+
 	return
 }
+
+// unwrap tries each identity in order to decrypt a stanza's data-key
+func unwrap(stanza Stanza, identities []Identity) (secret []byte, err error) {
+	for _, identity := range identities {
+		var err1 error
+
+		secret, err1 = identity.Unwrap(stanza)
+		if err1 == nil {
+			return secret, nil
+		}
+
+		if errors.Is(err1, ErrPIN) {
+			return nil, err1
+		}
+
+		err = multierr.Append(err, err1)
+	}
+
+	return nil, err
+}
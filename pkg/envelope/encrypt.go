@@ -3,66 +3,125 @@ package envelope
 import (
 	"crypto/aes"
 	"crypto/cipher"
-	"crypto/ecdsa"
 	"crypto/rand"
-	"crypto/rsa"
+	"encoding/json"
 	"errors"
+	"fmt"
 
 	"github.com/jmanero/vault-yubikey-helper/pkg/common"
-	"github.com/jmanero/vault-yubikey-helper/pkg/piv"
+	"github.com/jmanero/vault-yubikey-helper/pkg/shamir"
 	"go.uber.org/zap"
-	"pault.ag/go/ykpiv"
 )
 
-// ErrKeyMismatch is returned if an envelope's KeyID does not match the given private key
-var ErrKeyMismatch = errors.New("Private key does not match the public key used to encrypt this message")
+// Errors
+var (
+	ErrKeyMismatch        = errors.New("Private key does not match the public key used to encrypt this message")
+	ErrNoRecipients       = errors.New("At least one recipient is required to encrypt a message")
+	ErrDuplicateRecipient = errors.New("Recipient key is listed more than once")
+	ErrUnsupportedKey     = errors.New("Unsupported public key type")
+)
+
+// Stanza stores a data-key wrapped by a single recipient's public key
+type Stanza struct {
+	Algorithm string          `json:"alg"`
+	Device    uint32          `json:"dev"`
+	KeyID     string          `json:"kid"`
+	Metadata  json.RawMessage `json:"meta"`
+}
 
-// Writer stores metadata and the cipher-text of some JSON-encoded payload
+// Writer stores recipient stanzas and the cipher-text of some payload. If
+// Threshold is set, each stanza wraps a share of the data-key instead of the data-key,
+// except passphrase stanzas, which always wrap the whole data-key
 type Writer struct {
-	Device    uint32 `json:"dev"`
-	KeyID     string `json:"kid"`
-	Metadata  any    `json:"meta"`
-	Nonce     B64    `json:"nonce"`
-	Encrypted B64    `json:"enc"`
+	Version    int      `json:"v"`
+	Algorithm  string   `json:"alg"`
+	Threshold  int      `json:"t,omitempty"`
+	Recipients []Stanza `json:"rcpt"`
+	Nonce      B64      `json:"nonce"`
+	Encrypted  B64      `json:"enc"`
 }
 
-// Encrypt a value using the given card's public key
-func Encrypt(value any, opts piv.Options) (_ []byte, err error) {
-	token, err := piv.Open(opts.WithSlot(ykpiv.KeyManagement))
+// Encrypt a value with a random data-key, wrapped for each of the given recipients
+func Encrypt(value any, recipients ...Recipient) (_ []byte, err error) {
+	return EncryptThreshold(value, 0, recipients...)
+}
+
+// EncryptThreshold encrypts a value with a random data-key that is split into
+// shares for each of the given recipients. Any threshold of the recipients can
+// recover the data-key. A threshold of 0 wraps the whole data-key for each recipient.
+func EncryptThreshold(value any, threshold int, recipients ...Recipient) (_ []byte, err error) {
+	data, err := common.MarshalJSON(value)
 	if err != nil {
 		return
 	}
-	defer token.Close()
 
-	// Get the serial of an auto-selected device
-	serial, err := token.Serial()
-	if err != nil {
-		return
+	return Seal(data, threshold, recipients...)
+}
+
+// Seal encrypts raw data for the given recipients, like EncryptThreshold
+func Seal(data []byte, threshold int, recipients ...Recipient) (_ []byte, err error) {
+	if len(recipients) == 0 {
+		return nil, ErrNoRecipients
 	}
 
-	slot, err := token.KeyManagement()
+	secret := make([]byte, 32)
+	_, err = rand.Read(secret)
 	if err != nil {
 		return
 	}
 
-	envelope := Writer{Device: serial}
-	var secret []byte
-	envelope.KeyID = common.FingerprintKey(slot.PublicKey)
+	envelope := Writer{Version: Version, Algorithm: AlgorithmAESGCM, Threshold: threshold}
+
+	// Passphrase recipients are for break-glass recovery without any PIV device, and are not counted in the threshold
+	var shares [][]byte
+	if threshold > 0 {
+		var n int
+		for _, recipient := range recipients {
+			if _, is := recipient.(PassphraseRecipient); !is {
+				n++
+			}
+		}
+
+		common.Logger.Info("Splitting data-key", zap.Int("t", threshold), zap.Int("n", n))
+		shares, err = shamir.Split(secret, n, threshold)
+		if err != nil {
+			return
+		}
+	}
+
+	keys := make(map[string]struct{})
+	for _, recipient := range recipients {
+		share := secret
+		if _, is := recipient.(PassphraseRecipient); !is && threshold > 0 {
+			share, shares = shares[0], shares[1:]
+		}
 
-	switch key := slot.PublicKey.(type) {
-	case *ecdsa.PublicKey:
-		common.Logger.Info("Encrypting with ECDH/AES", zap.String("key_id", envelope.KeyID))
-		secret, envelope.Metadata, err = EncryptEC(key)
+		var stanza Stanza
 
-	case *rsa.PublicKey:
-		common.Logger.Info("Encrypting with RSA+OAEP/AES", zap.String("key_id", envelope.KeyID))
-		secret, envelope.Metadata, err = EncryptRSA(key)
+		stanza, err = recipient.Wrap(share)
+		if err != nil {
+			return
+		}
+
+		// Each share must be held by a different key
+		if _, has := keys[stanza.KeyID]; has {
+			return nil, fmt.Errorf("%w: %s", ErrDuplicateRecipient, stanza.KeyID)
+		}
+
+		keys[stanza.KeyID] = struct{}{}
+		envelope.Recipients = append(envelope.Recipients, stanza)
 	}
 
+	err = envelope.seal(secret, data)
 	if err != nil {
 		return
 	}
 
+	return common.MarshalJSON(envelope)
+}
+
+// seal encrypts data with the data-key under a new nonce, authenticating the envelope's header fields
+func (envelope *Writer) seal(secret, data []byte) (err error) {
 	block, err := aes.NewCipher(secret)
 	if err != nil {
 		return
@@ -73,18 +132,17 @@ func Encrypt(value any, opts piv.Options) (_ []byte, err error) {
 		return
 	}
 
-	data, err := common.MarshalJSON(value)
+	envelope.Nonce = make([]byte, aead.NonceSize())
+	_, err = rand.Read(envelope.Nonce)
 	if err != nil {
 		return
 	}
 
-	envelope.Nonce = make([]byte, aead.NonceSize())
-	_, err = rand.Read(envelope.Nonce)
+	ad, err := AdditionalData(envelope.Version, envelope.Algorithm, envelope.Threshold, envelope.Recipients)
 	if err != nil {
 		return
 	}
 
-	envelope.Encrypted = aead.Seal(nil, envelope.Nonce, data, nil)
-
-	return common.MarshalJSON(envelope)
+	envelope.Encrypted = aead.Seal(nil, envelope.Nonce, data, ad)
+	return
 }
@@ -3,17 +3,91 @@ package envelope
 import (
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// KDF identifiers for ECDH shared secrets
+const (
+	KDFSHA256 = "HKDF-SHA256"
+	KDFSHA384 = "HKDF-SHA384"
 )
 
-// ECMetadata stores state required for decryption of an ECDH/AES encrypted payload
+// ErrUnsupportedCurve is returned for EC keys on curves other than P-256 and P-384
+var ErrUnsupportedCurve = errors.New("Unsupported elliptic curve")
+
+// ECMetadata stores state required for decryption of an ECDH/AES encrypted payload. Stanzas
+// without a KDF use the raw ECDH shared secret as the key-encryption key, or as the data-key
+// itself for legacy envelopes without a WrappedKey
 type ECMetadata struct {
-	EphemeralKey B64 `json:"epk"`
+	EphemeralKey B64    `json:"epk"`
+	KDF          string `json:"kdf,omitempty"`
+	WrappedKey   B64    `json:"wk,omitempty"`
+}
+
+// CurveKDF returns the KDF identifier used with keys on the given curve
+func CurveKDF(curve elliptic.Curve) (string, error) {
+	switch curve {
+	case elliptic.P256():
+		return KDFSHA256, nil
+	case elliptic.P384():
+		return KDFSHA384, nil
+	default:
+		return "", fmt.Errorf("%w: %s", ErrUnsupportedCurve, curve.Params().Name)
+	}
+}
+
+// Curve infers the curve of the ephemeral public-key from its length. Ephemeral keys are
+// stored in uncompressed form, which has a fixed length for each curve
+func (meta ECMetadata) Curve() (elliptic.Curve, error) {
+	for _, curve := range []elliptic.Curve{elliptic.P256(), elliptic.P384()} {
+		if len(meta.EphemeralKey) == 1+2*((curve.Params().BitSize+7)/8) {
+			return curve, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %d byte ephemeral key", ErrUnsupportedCurve, len(meta.EphemeralKey))
+}
+
+// DeriveKey derives an AES-256 key-encryption key from an ECDH shared secret, bound to the
+// ephemeral public-key and the recipient's key ID
+func DeriveKey(kdf string, shared, ephemeral []byte, kid string) (kek []byte, err error) {
+	var hasher func() hash.Hash
+
+	switch kdf {
+	case KDFSHA256:
+		hasher = sha256.New
+	case KDFSHA384:
+		hasher = sha512.New384
+	default:
+		return nil, fmt.Errorf("%w: KDF %q", ErrUnsupportedAlgorithm, kdf)
+	}
+
+	// Ephemeral keys have a fixed length for each curve, so the info parameter is unambiguous
+	info := append([]byte(SchemeECDH+"\x00"), ephemeral...)
+	info = append(info, kid...)
+
+	kek = make([]byte, 32)
+	_, err = io.ReadFull(hkdf.New(hasher, shared, nil, info), kek)
+	return
 }
 
-// EncryptEC derives a DH secret from the given public-ke and an ephemeral private key
-func EncryptEC(key *ecdsa.PublicKey) (secret []byte, meta ECMetadata, err error) {
+// EncryptEC derives a DH secret from the given public-key and an ephemeral private key, and uses it to wrap a data-key
+func EncryptEC(key *ecdsa.PublicKey, kid string, secret []byte) (meta ECMetadata, err error) {
+	meta.KDF, err = CurveKDF(key.Curve)
+	if err != nil {
+		return
+	}
+
 	// Generate an ephemeral private key using the same curve as the PIV key
 	ephemeral, err := ecdsa.GenerateKey(key.Curve, rand.Reader)
 	if err != nil {
@@ -34,20 +108,47 @@ func EncryptEC(key *ecdsa.PublicKey) (secret []byte, meta ECMetadata, err error)
 	// Store the ephemeral public key to re-generate the shared secret for decryption
 	meta.EphemeralKey = dephem.PublicKey().Bytes()
 
-	// Derive a shared secret for encipherment
-	secret, err = dephem.ECDH(dpub)
+	// Derive a shared secret for encipherment of the data-key
+	shared, err := dephem.ECDH(dpub)
+	if err != nil {
+		return
+	}
+
+	kek, err := DeriveKey(meta.KDF, shared, meta.EphemeralKey, kid)
+	if err != nil {
+		return
+	}
+
+	meta.WrappedKey, err = WrapKey(kek, secret)
 	return
 }
 
-// DecryptEC re-derives a DH secret from a Yubikey and an ephemeral public-key stored in an envelope's metadata
-func DecryptEC(key crypto.Decrypter, envelope Reader) (secret []byte, err error) {
+// DecryptEC re-derives a DH secret from a Yubikey and an ephemeral public-key stored in a stanza's metadata
+func DecryptEC(key crypto.Decrypter, stanza Stanza) (secret []byte, err error) {
 	var meta ECMetadata
-	err = json.Unmarshal(envelope.Metadata, &meta)
+	err = json.Unmarshal(stanza.Metadata, &meta)
 	if err != nil {
 		return
 	}
 
 	// Recover the shared secret for deciphering
-	secret, err = key.Decrypt(nil, meta.EphemeralKey, nil)
-	return
+	shared, err := key.Decrypt(nil, meta.EphemeralKey, nil)
+	if err != nil {
+		return
+	}
+
+	if len(meta.WrappedKey) == 0 {
+		// Legacy single-recipient envelopes use the shared secret as the data-key
+		return shared, nil
+	}
+
+	kek := shared
+	if len(meta.KDF) > 0 {
+		kek, err = DeriveKey(meta.KDF, shared, meta.EphemeralKey, stanza.KeyID)
+		if err != nil {
+			return
+		}
+	}
+
+	return UnwrapKey(kek, meta.WrappedKey)
 }
@@ -0,0 +1,100 @@
+package envelope
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+var curveTests = []struct {
+	curve elliptic.Curve
+	kdf   string
+}{
+	{elliptic.P256(), KDFSHA256},
+	{elliptic.P384(), KDFSHA384},
+}
+
+func TestECRoundTrip(t *testing.T) {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+
+	for _, tt := range curveTests {
+		name := tt.curve.Params().Name
+
+		key, err := ecdsa.GenerateKey(tt.curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		meta, err := EncryptEC(&key.PublicKey, "test-kid", secret)
+		if err != nil {
+			t.Fatalf("EncryptEC(%s) error = %v", name, err)
+		}
+
+		if meta.KDF != tt.kdf {
+			t.Errorf("EncryptEC(%s) KDF = %s, want %s", name, meta.KDF, tt.kdf)
+		}
+
+		if curve, err := meta.Curve(); err != nil || curve != tt.curve {
+			t.Errorf("ECMetadata.Curve(%s) = %v, %v", name, curve, err)
+		}
+
+		stanza := Stanza{Algorithm: SchemeECDH, KeyID: "test-kid"}
+		stanza.Metadata, _ = json.Marshal(meta)
+
+		out, err := DecryptEC(ECDHKey{key}, stanza)
+		if err != nil {
+			t.Errorf("DecryptEC(%s) error = %v", name, err)
+		} else if !bytes.Equal(out, secret) {
+			t.Errorf("DecryptEC(%s) = %x, want %x", name, out, secret)
+		}
+
+		// The derived key is bound to the recipient's key ID
+		stanza.KeyID = "other-kid"
+		if _, err = DecryptEC(ECDHKey{key}, stanza); err == nil {
+			t.Errorf("DecryptEC(%s) with a different key ID succeeded", name)
+		}
+
+		// A different private key on the same curve can not unwrap the data-key
+		other, _ := ecdsa.GenerateKey(tt.curve, rand.Reader)
+		stanza.KeyID = "test-kid"
+
+		if _, err = DecryptEC(ECDHKey{other}, stanza); err == nil {
+			t.Errorf("DecryptEC(%s) with a different private key succeeded", name)
+		}
+	}
+}
+
+func TestECLegacy(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ephemeral, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	dpub, _ := key.PublicKey.ECDH()
+	dephem, _ := ephemeral.ECDH()
+	shared, _ := dephem.ECDH(dpub)
+
+	// Legacy envelopes use the raw shared secret as the data-key
+	stanza := Stanza{Algorithm: SchemeECDH}
+	stanza.Metadata, _ = json.Marshal(ECMetadata{EphemeralKey: dephem.PublicKey().Bytes()})
+
+	out, err := DecryptEC(ECDHKey{key}, stanza)
+	if err != nil {
+		t.Fatalf("DecryptEC(legacy) error = %v", err)
+	}
+
+	if !bytes.Equal(out, shared) {
+		t.Errorf("DecryptEC(legacy) = %x, want %x", out, shared)
+	}
+}
+
+func TestECUnsupportedCurve(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+
+	if _, err := EncryptEC(&key.PublicKey, "test-kid", make([]byte, 32)); !errors.Is(err, ErrUnsupportedCurve) {
+		t.Errorf("EncryptEC(P-521) error = %v, want %v", err, ErrUnsupportedCurve)
+	}
+}
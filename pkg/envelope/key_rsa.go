@@ -4,36 +4,61 @@ import (
 	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"encoding/json"
+	"fmt"
 )
 
-// RSAMetadata stores state required for decryption of a PKCS1v15/AES encrypted payload
+// RSA key-wrapping algorithm identifiers
+const (
+	RSAOAEP256  = "RSA-OAEP-256"
+	RSAPKCS1v15 = "RSA1_5"
+)
+
+// RSAMetadata stores state required for decryption of an RSA/AES encrypted payload. Stanzas
+// without an Algorithm were wrapped with PKCS1v15
 type RSAMetadata struct {
-	CipherKey B64 `json:"eck"`
+	Algorithm string `json:"alg,omitempty"`
+	CipherKey B64    `json:"eck"`
 }
 
-// EncryptRSA generates and encrypts a shared secret
-func EncryptRSA(pub *rsa.PublicKey) (secret []byte, meta RSAMetadata, err error) {
-	secret = make([]byte, 32)
-	_, err = rand.Read(secret)
-	if err != nil {
-		return
-	}
+// EncryptRSA encrypts a data-key with the given public-key using RSA-OAEP with SHA-256, or PKCS1v15
+// for keys held by PIV devices, which only remove PKCS1v15 padding when decrypting
+func EncryptRSA(pub *rsa.PublicKey, algorithm string, secret []byte) (meta RSAMetadata, err error) {
+	meta.Algorithm = algorithm
 
 	// Use the RSA key to encrypt the symmetrical encryption secret
-	meta.CipherKey, err = rsa.EncryptPKCS1v15(rand.Reader, pub, secret)
+	switch algorithm {
+	case RSAOAEP256:
+		meta.CipherKey, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, secret, nil)
+
+	case RSAPKCS1v15:
+		meta.CipherKey, err = rsa.EncryptPKCS1v15(rand.Reader, pub, secret)
+
+	default:
+		err = fmt.Errorf("%w: %q", ErrUnsupportedAlgorithm, algorithm)
+	}
+
 	return
 }
 
-// DecryptRSA decrypts a shared secret from envelope metadata
-func DecryptRSA(key crypto.Decrypter, envelope Reader) (secret []byte, err error) {
+// DecryptRSA decrypts a data-key from stanza metadata
+func DecryptRSA(key crypto.Decrypter, stanza Stanza) (secret []byte, err error) {
 	var meta RSAMetadata
-	err = json.Unmarshal(envelope.Metadata, &meta)
+	err = json.Unmarshal(stanza.Metadata, &meta)
 	if err != nil {
 		return
 	}
 
 	// Decrypt the symmetrical secret
-	secret, err = key.Decrypt(rand.Reader, meta.CipherKey, rsa.PKCS1v15DecryptOptions{SessionKeyLen: 32})
-	return
+	switch meta.Algorithm {
+	case RSAOAEP256:
+		return key.Decrypt(rand.Reader, meta.CipherKey, &rsa.OAEPOptions{Hash: crypto.SHA256})
+
+	case RSAPKCS1v15, "":
+		return key.Decrypt(rand.Reader, meta.CipherKey, &rsa.PKCS1v15DecryptOptions{})
+
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedAlgorithm, meta.Algorithm)
+	}
 }
@@ -0,0 +1,113 @@
+package envelope
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"io"
+	"testing"
+)
+
+var rsaSizes = []int{2048, 3072, 4096}
+
+func TestRSARoundTrip(t *testing.T) {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+
+	for _, bits := range rsaSizes {
+		key, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		meta, err := EncryptRSA(&key.PublicKey, RSAOAEP256, secret)
+		if err != nil {
+			t.Fatalf("EncryptRSA(%d) error = %v", bits, err)
+		}
+
+		if meta.Algorithm != RSAOAEP256 {
+			t.Errorf("EncryptRSA(%d) algorithm = %s, want %s", bits, meta.Algorithm, RSAOAEP256)
+		}
+
+		stanza := Stanza{Algorithm: SchemeRSA}
+		stanza.Metadata, _ = json.Marshal(meta)
+
+		out, err := DecryptRSA(key, stanza)
+		if err != nil {
+			t.Errorf("DecryptRSA(%d) error = %v", bits, err)
+		} else if !bytes.Equal(out, secret) {
+			t.Errorf("DecryptRSA(%d) = %x, want %x", bits, out, secret)
+		}
+
+		// Legacy stanzas without an algorithm were wrapped with PKCS1v15
+		legacy, err := rsa.EncryptPKCS1v15(rand.Reader, &key.PublicKey, secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stanza.Metadata, _ = json.Marshal(RSAMetadata{CipherKey: legacy})
+
+		out, err = DecryptRSA(key, stanza)
+		if err != nil {
+			t.Errorf("DecryptRSA(%d, legacy) error = %v", bits, err)
+		} else if !bytes.Equal(out, secret) {
+			t.Errorf("DecryptRSA(%d, legacy) = %x, want %x", bits, out, secret)
+		}
+	}
+}
+
+// pivDecrypter behaves like an RSA slot of ykpiv: it ignores decrypter options, and always removes PKCS1v15 padding
+type pivDecrypter struct {
+	*rsa.PrivateKey
+}
+
+func (key pivDecrypter) Decrypt(_ io.Reader, msg []byte, _ crypto.DecrypterOpts) ([]byte, error) {
+	return rsa.DecryptPKCS1v15(nil, key.PrivateKey, msg)
+}
+
+func TestRSAPIVRecipient(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret := make([]byte, 32)
+	rand.Read(secret)
+
+	stanza, err := KeyRecipient{Device: 1234, PIV: true, PublicKey: &key.PublicKey}.Wrap(secret)
+	if err != nil {
+		t.Fatalf("Wrap() error = %v", err)
+	}
+
+	var meta RSAMetadata
+	json.Unmarshal(stanza.Metadata, &meta)
+
+	if meta.Algorithm != RSAPKCS1v15 {
+		t.Errorf("Wrap(PIV) algorithm = %s, want %s", meta.Algorithm, RSAPKCS1v15)
+	}
+
+	out, err := KeyIdentity{Key: pivDecrypter{key}}.Unwrap(stanza)
+	if err != nil {
+		t.Fatalf("Unwrap(PIV) error = %v", err)
+	}
+
+	if !bytes.Equal(out, secret) {
+		t.Errorf("Unwrap(PIV) = %x, want %x", out, secret)
+	}
+}
+
+func TestRSAUnsupportedAlgorithm(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stanza := Stanza{Algorithm: SchemeRSA}
+	stanza.Metadata, _ = json.Marshal(RSAMetadata{Algorithm: "RSA-OAEP-512", CipherKey: []byte{0}})
+
+	if _, err = DecryptRSA(key, stanza); err == nil {
+		t.Error("DecryptRSA(RSA-OAEP-512) succeeded")
+	}
+}
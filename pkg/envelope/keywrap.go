@@ -0,0 +1,51 @@
+package envelope
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+)
+
+// ErrWrappedKey is returned if a wrapped data-key is too short to contain a nonce
+var ErrWrappedKey = errors.New("Wrapped key is truncated")
+
+// WrapKey encrypts a data-key with AES-GCM, prefixing the cipher-text with a random nonce
+func WrapKey(kek, secret []byte) (wrapped []byte, err error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return
+	}
+
+	return aead.Seal(nonce, nonce, secret, nil), nil
+}
+
+// UnwrapKey decrypts a data-key wrapped by WrapKey
+func UnwrapKey(kek, wrapped []byte) (secret []byte, err error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return
+	}
+
+	if len(wrapped) < aead.NonceSize() {
+		return nil, ErrWrappedKey
+	}
+
+	return aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], nil)
+}
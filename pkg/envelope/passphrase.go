@@ -0,0 +1,108 @@
+package envelope
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/jmanero/vault-yubikey-helper/pkg/common"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Default scrypt parameters for new passphrase stanzas
+const (
+	ScryptN = 1 << 17
+	ScryptR = 8
+	ScryptP = 1
+
+	// Reject stanzas that would require more than 1GiB of memory to derive
+	scryptMaxMemory = 1 << 30
+)
+
+// PassphraseKeyID identifies passphrase stanzas. An envelope may have only one
+const PassphraseKeyID = "passphrase"
+
+// ErrScryptParameters is returned for stanzas with invalid or excessive scrypt parameters
+var ErrScryptParameters = errors.New("Invalid scrypt parameters")
+
+// ScryptMetadata stores the KDF parameters and wrapped data-key of a passphrase stanza
+type ScryptMetadata struct {
+	Salt       B64 `json:"salt"`
+	N          int `json:"n"`
+	R          int `json:"r"`
+	P          int `json:"p"`
+	WrappedKey B64 `json:"wk"`
+}
+
+// derive a key-encryption key from a passphrase
+func (meta ScryptMetadata) derive(passphrase []byte) ([]byte, error) {
+	if meta.N < 2 || meta.R < 1 || meta.P < 1 || 128*meta.N*meta.R > scryptMaxMemory {
+		return nil, fmt.Errorf("%w: N=%d r=%d p=%d", ErrScryptParameters, meta.N, meta.R, meta.P)
+	}
+
+	return scrypt.Key(passphrase, meta.Salt, meta.N, meta.R, meta.P, 32)
+}
+
+// PassphraseRecipient wraps data-keys with a key derived from a passphrase
+type PassphraseRecipient struct {
+	Passphrase []byte
+}
+
+// Wrap encrypts a data-key with a key derived from the recipient's passphrase and a random salt
+func (recipient PassphraseRecipient) Wrap(secret []byte) (stanza Stanza, err error) {
+	stanza.Algorithm = SchemeScrypt
+	stanza.KeyID = PassphraseKeyID
+
+	meta := ScryptMetadata{Salt: make([]byte, 16), N: ScryptN, R: ScryptR, P: ScryptP}
+	_, err = rand.Read(meta.Salt)
+	if err != nil {
+		return
+	}
+
+	common.Logger.Info("Wrapping data-key", zap.String("alg", stanza.Algorithm), zap.String("key_id", stanza.KeyID))
+	kek, err := meta.derive(recipient.Passphrase)
+	if err != nil {
+		return
+	}
+
+	meta.WrappedKey, err = WrapKey(kek, secret)
+	if err != nil {
+		return
+	}
+
+	stanza.Metadata, err = json.Marshal(meta)
+	return
+}
+
+// PassphraseIdentity unwraps data-keys from passphrase stanzas
+type PassphraseIdentity struct {
+	Passphrase []byte
+}
+
+// Unwrap decrypts a passphrase stanza's data-key
+func (identity PassphraseIdentity) Unwrap(stanza Stanza) (secret []byte, err error) {
+	if stanza.Algorithm != SchemeScrypt {
+		return nil, fmt.Errorf("%w: %s is not a passphrase stanza", ErrKeyMismatch, stanza.KeyID)
+	}
+
+	var meta ScryptMetadata
+	err = json.Unmarshal(stanza.Metadata, &meta)
+	if err != nil {
+		return
+	}
+
+	common.Logger.Info("Unwrapping data-key", zap.String("alg", stanza.Algorithm), zap.String("key_id", stanza.KeyID))
+	kek, err := meta.derive(identity.Passphrase)
+	if err != nil {
+		return
+	}
+
+	secret, err = UnwrapKey(kek, meta.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: incorrect passphrase", ErrKeyMismatch)
+	}
+
+	return
+}
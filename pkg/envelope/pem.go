@@ -0,0 +1,141 @@
+package envelope
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrNoPEMObject is returned if a PEM encoded key or certificate can not be found
+var ErrNoPEMObject = errors.New("Unable to decode a PEM encoded key or certificate")
+
+// SerialHeader labels the serial of the PIV device that holds a recipient's private key. It is written on a
+// line before the PEM block, which OpenSSL ignores. Files exported by older releases record it as a PEM header
+const SerialHeader = "Serial"
+
+// EncodeRecipient PEM encodes a recipient's public-key, or a certificate for its public-key if one is given
+func EncodeRecipient(recipient KeyRecipient, cert *x509.Certificate) (_ []byte, err error) {
+	block := pem.Block{Type: "CERTIFICATE"}
+
+	if cert != nil {
+		block.Bytes = cert.Raw
+	} else {
+		block.Type = "PUBLIC KEY"
+
+		block.Bytes, err = x509.MarshalPKIXPublicKey(recipient.PublicKey)
+		if err != nil {
+			return
+		}
+	}
+
+	var buffer bytes.Buffer
+	if recipient.Device > 0 {
+		fmt.Fprintf(&buffer, "%s: %d\n", SerialHeader, recipient.Device)
+	}
+
+	err = pem.Encode(&buffer, &block)
+	return buffer.Bytes(), err
+}
+
+// parseSerial reads a PIV device serial from the lines before a PEM block, or from a legacy PEM header
+func parseSerial(preamble []byte, block *pem.Block) (_ uint32, err error) {
+	serial, has := block.Headers[SerialHeader]
+
+	for _, line := range strings.Split(string(preamble), "\n") {
+		if value, found := strings.CutPrefix(strings.TrimSpace(line), SerialHeader+":"); found {
+			serial, has = strings.TrimSpace(value), true
+		}
+	}
+
+	if !has {
+		return
+	}
+
+	device, err := strconv.ParseUint(serial, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid %s %q", ErrNoPEMObject, SerialHeader, serial)
+	}
+
+	return uint32(device), nil
+}
+
+// ParseRecipient reads a public-key from a PEM encoded PUBLIC KEY or CERTIFICATE, and
+// a PIV device serial from an optional Serial line before it. Keys with a serial are held by a PIV device
+func ParseRecipient(data []byte) (recipient KeyRecipient, err error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return recipient, ErrNoPEMObject
+	}
+
+	preamble, _, _ := bytes.Cut(data, []byte("-----BEGIN "))
+
+	recipient.Device, err = parseSerial(preamble, block)
+	if err != nil {
+		return
+	}
+
+	recipient.PIV = recipient.Device > 0
+
+	switch block.Type {
+	case "PUBLIC KEY":
+		recipient.PublicKey, err = x509.ParsePKIXPublicKey(block.Bytes)
+
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+
+		cert, err = x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return
+		}
+
+		recipient.PublicKey = cert.PublicKey
+
+	default:
+		return recipient, fmt.Errorf("%w: unexpected type %q", ErrNoPEMObject, block.Type)
+	}
+
+	return
+}
+
+// ParseIdentity reads a private key from a PEM encoded PRIVATE KEY, EC PRIVATE KEY, or RSA PRIVATE KEY
+func ParseIdentity(data []byte) (identity KeyIdentity, err error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return identity, ErrNoPEMObject
+	}
+
+	var key crypto.PrivateKey
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return identity, fmt.Errorf("%w: unexpected type %q", ErrNoPEMObject, block.Type)
+	}
+
+	if err != nil {
+		return
+	}
+
+	switch priv := key.(type) {
+	case *ecdsa.PrivateKey:
+		identity.Key = ECDHKey{priv}
+	case *rsa.PrivateKey:
+		identity.Key = priv
+	default:
+		err = fmt.Errorf("%w: %T", ErrUnsupportedKey, key)
+	}
+
+	return
+}
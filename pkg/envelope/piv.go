@@ -0,0 +1,98 @@
+package envelope
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"github.com/jmanero/vault-yubikey-helper/pkg/common"
+	"github.com/jmanero/vault-yubikey-helper/pkg/piv"
+	"go.uber.org/zap"
+	"pault.ag/go/ykpiv"
+)
+
+// ErrPIN is returned if a PIV device rejects the PIN, or has locked it. Decryption stops at the first
+// ErrPIN, as each attempt with the same PIN uses up one of a device's PIN retries
+var ErrPIN = errors.New("PIV device rejected the PIN")
+
+// pinError reports whether a PIV device error is a PIN failure
+func pinError(err error) bool {
+	var yerr ykpiv.Error
+	return errors.As(err, &yerr) && (ykpiv.WrongPIN.Equal(yerr) || ykpiv.PINLockedError.Equal(yerr) || ykpiv.AuthBlocked.Equal(yerr))
+}
+
+// PIVRecipient reads the public-key of a PIV device's key-management slot
+func PIVRecipient(opts piv.Options) (recipient KeyRecipient, err error) {
+	recipient, _, err = PIVCertificate(opts)
+	return
+}
+
+// PIVCertificate reads the public-key and certificate of a PIV device's key-management slot.
+// The certificate may be nil for attested keys
+func PIVCertificate(opts piv.Options) (recipient KeyRecipient, cert *x509.Certificate, err error) {
+	token, err := piv.Open(opts.WithSlot(ykpiv.KeyManagement))
+	if err != nil {
+		return
+	}
+	defer token.Close()
+
+	// Get the serial of an auto-selected device
+	recipient.Device, err = token.Serial()
+	if err != nil {
+		return
+	}
+
+	slot, err := token.KeyManagement()
+	if err != nil {
+		return
+	}
+
+	recipient.PIV, recipient.PublicKey = true, slot.PublicKey
+	return recipient, slot.Certificate, nil
+}
+
+// PIVIdentity unwraps data-keys with the key-management slot of any attached PIV device whose
+// public-key matches each stanza's key ID
+type PIVIdentity struct {
+	Options piv.Options
+}
+
+// Unwrap decrypts a stanza's data-key with the PIV device holding its key
+func (identity PIVIdentity) Unwrap(stanza Stanza) (secret []byte, err error) {
+	// Match devices by public-key rather than the stanza's serial, which may be stale or edited
+	opts := identity.Options.WithSlot(ykpiv.KeyManagement)
+	opts.Serial = 0
+
+	token, info, err := piv.Match(opts, func(card piv.CardInfo) error {
+		if !common.MatchFingerprint(card.PublicKey, stanza.KeyID) {
+			return fmt.Errorf("%w: %s != %s", ErrKeyMismatch, stanza.KeyID, common.FingerprintSPKI(card.PublicKey))
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return
+	}
+	defer token.Close()
+
+	if info.Serial != stanza.Device {
+		common.Logger.Warn("Recipient key found on a PIV device with a different serial", zap.Uint32("serial", info.Serial), zap.Uint32("recipient", stanza.Device))
+	}
+
+	err = token.Login()
+	if pinError(err) {
+		return nil, fmt.Errorf("%w: PIV device %d: %w", ErrPIN, info.Serial, err)
+	}
+
+	if err != nil {
+		return
+	}
+
+	slot, err := token.KeyManagement()
+	if err != nil {
+		return
+	}
+
+	return KeyIdentity{Key: slot}.Unwrap(stanza)
+}
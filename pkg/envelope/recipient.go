@@ -0,0 +1,94 @@
+package envelope
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/jmanero/vault-yubikey-helper/pkg/common"
+	"go.uber.org/zap"
+)
+
+// Recipient wraps a data-key into an envelope stanza
+type Recipient interface {
+	Wrap(secret []byte) (Stanza, error)
+}
+
+// Identity unwraps a data-key from an envelope stanza
+type Identity interface {
+	Unwrap(stanza Stanza) ([]byte, error)
+}
+
+// KeyRecipient wraps data-keys with a public-key. Device is recorded in stanzas
+// to identify the PIV device holding the matching private key, if any. PIV marks keys
+// held by a PIV device, whose RSA slots can only remove PKCS1v15 padding
+type KeyRecipient struct {
+	Device    uint32
+	PIV       bool
+	PublicKey crypto.PublicKey
+}
+
+// Wrap encrypts a data-key with the recipient's public-key
+func (recipient KeyRecipient) Wrap(secret []byte) (stanza Stanza, err error) {
+	stanza.Device = recipient.Device
+	stanza.KeyID = common.FingerprintSPKI(recipient.PublicKey)
+
+	stanza.Algorithm, err = SchemeFor(recipient.PublicKey)
+	if err != nil {
+		return
+	}
+
+	common.Logger.Info("Wrapping data-key", zap.String("alg", stanza.Algorithm), zap.Uint32("serial", stanza.Device), zap.String("key_id", stanza.KeyID))
+
+	meta, err := Schemes[stanza.Algorithm].Wrap(recipient, stanza.KeyID, secret)
+	if err != nil {
+		return
+	}
+
+	stanza.Metadata, err = json.Marshal(meta)
+	return
+}
+
+// KeyIdentity unwraps data-keys with a private key
+type KeyIdentity struct {
+	Key crypto.Decrypter
+}
+
+// Unwrap decrypts a stanza's data-key if it was wrapped with the identity's public-key
+func (identity KeyIdentity) Unwrap(stanza Stanza) (secret []byte, err error) {
+	scheme, err := GetScheme(stanza.Algorithm)
+	if err != nil {
+		return
+	}
+
+	// Envelopes written by older releases identify keys by their legacy fingerprints
+	if !common.MatchFingerprint(identity.Key.Public(), stanza.KeyID) {
+		return nil, fmt.Errorf("%w: %s != %s", ErrKeyMismatch, stanza.KeyID, common.FingerprintSPKI(identity.Key.Public()))
+	}
+
+	common.Logger.Info("Unwrapping data-key", zap.String("alg", stanza.Algorithm), zap.Uint32("serial", stanza.Device), zap.String("key_id", stanza.KeyID))
+	return scheme.Unwrap(identity.Key, stanza)
+}
+
+// ECDHKey implements crypto.Decrypter for EC private keys like the key-management slot of a PIV
+// device: Decrypt performs ECDH with a peer public-key and returns the shared secret
+type ECDHKey struct {
+	*ecdsa.PrivateKey
+}
+
+// Decrypt derives an ECDH shared secret with the peer public-key encoded in msg
+func (key ECDHKey) Decrypt(_ io.Reader, msg []byte, _ crypto.DecrypterOpts) ([]byte, error) {
+	priv, err := key.ECDH()
+	if err != nil {
+		return nil, err
+	}
+
+	peer, err := priv.Curve().NewPublicKey(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return priv.ECDH(peer)
+}
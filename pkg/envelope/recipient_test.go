@@ -0,0 +1,344 @@
+package envelope
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/jmanero/vault-yubikey-helper/pkg/common"
+)
+
+type secrets struct {
+	Keys      []string `json:"keys"`
+	RootToken string   `json:"root_token"`
+}
+
+var message = secrets{Keys: []string{"unseal-key"}, RootToken: "root-token"}
+
+// generateIdentities creates software identities and their recipients for each supported key type
+func generateIdentities(t *testing.T) (identities []Identity, recipients []Recipient) {
+	t.Helper()
+
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	r2048, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identities = []Identity{KeyIdentity{ECDHKey{p256}}, KeyIdentity{ECDHKey{p384}}, KeyIdentity{r2048}}
+	recipients = []Recipient{KeyRecipient{PublicKey: &p256.PublicKey}, KeyRecipient{PublicKey: &p384.PublicKey}, KeyRecipient{PublicKey: &r2048.PublicKey}}
+
+	return
+}
+
+func TestEncryptAnyRecipient(t *testing.T) {
+	identities, recipients := generateIdentities(t)
+
+	payload, err := Encrypt(message, recipients...)
+	if err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+
+	// Each identity can decrypt the envelope alone
+	for i, identity := range identities {
+		var out secrets
+
+		opened, err := Decrypt(payload, &out, identity)
+		if err != nil {
+			t.Errorf("Decrypt(identity %d) error = %v", i, err)
+			continue
+		}
+
+		if len(opened) != 1 || out.RootToken != message.RootToken {
+			t.Errorf("Decrypt(identity %d) = %d stanzas, %+v", i, len(opened), out)
+		}
+	}
+}
+
+func TestEncryptThreshold(t *testing.T) {
+	identities, recipients := generateIdentities(t)
+
+	payload, err := EncryptThreshold(message, 2, recipients...)
+	if err != nil {
+		t.Fatalf("EncryptThreshold() error = %v", err)
+	}
+
+	var out secrets
+	if _, err = Decrypt(payload, &out, identities[0]); !errors.Is(err, ErrNoQuorum) {
+		t.Errorf("Decrypt(1 of 2) error = %v, want %v", err, ErrNoQuorum)
+	}
+
+	opened, err := Decrypt(payload, &out, identities[1], identities[2])
+	if err != nil {
+		t.Fatalf("Decrypt(2 of 2) error = %v", err)
+	}
+
+	if len(opened) != 2 || out.RootToken != message.RootToken {
+		t.Errorf("Decrypt(2 of 2) = %d stanzas, %+v", len(opened), out)
+	}
+
+	if _, err = EncryptThreshold(message, 2, recipients[0], recipients[0]); !errors.Is(err, ErrDuplicateRecipient) {
+		t.Errorf("EncryptThreshold(duplicate) error = %v, want %v", err, ErrDuplicateRecipient)
+	}
+}
+
+func TestReplace(t *testing.T) {
+	identities, recipients := generateIdentities(t)
+
+	payload, err := EncryptThreshold(message, 2, recipients...)
+	if err != nil {
+		t.Fatalf("EncryptThreshold() error = %v", err)
+	}
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	replacement := KeyIdentity{ECDHKey{key}}
+
+	kid := common.FingerprintSPKI(recipients[0].(KeyRecipient).PublicKey)
+	match := func(stanza Stanza) bool { return stanza.KeyID == kid }
+
+	resolve := func(stanzas []Stanza) (resolved []Recipient, err error) {
+		for _, stanza := range stanzas {
+			for _, recipient := range recipients {
+				if common.FingerprintSPKI(recipient.(KeyRecipient).PublicKey) == stanza.KeyID {
+					resolved = append(resolved, recipient)
+				}
+			}
+		}
+
+		return
+	}
+
+	rotated, err := Replace(payload, match, KeyRecipient{PublicKey: &key.PublicKey}, resolve, identities[1], identities[2])
+	if err != nil {
+		t.Fatalf("Replace() error = %v", err)
+	}
+
+	var out secrets
+	if _, err = Decrypt(rotated, &out, replacement, identities[2]); err != nil || out.RootToken != message.RootToken {
+		t.Errorf("Decrypt(replacement) = %+v, %v", out, err)
+	}
+
+	if _, err = Decrypt(rotated, &out, identities[0], identities[2]); !errors.Is(err, ErrNoQuorum) {
+		t.Errorf("Decrypt(replaced) error = %v, want %v", err, ErrNoQuorum)
+	}
+
+	// Shares of the original envelope can not be combined with shares of the rotated envelope
+	original, _ := Parse(payload)
+	updated, _ := Parse(rotated)
+
+	before, _ := unwrap(original.Recipients[1], identities[1:2])
+	after, _ := unwrap(updated.Recipients[1], identities[1:2])
+	if bytes.Equal(before, after) {
+		t.Errorf("Replace() kept data-key share %x", after)
+	}
+
+	if _, err = Replace(rotated, match, KeyRecipient{PublicKey: &key.PublicKey}, resolve, identities[1], identities[2]); !errors.Is(err, ErrRecipientNotFound) {
+		t.Errorf("Replace(missing) error = %v, want %v", err, ErrRecipientNotFound)
+	}
+}
+
+// wrongPinIdentity fails like a PIV identity whose device rejects the PIN
+type wrongPinIdentity struct{}
+
+func (wrongPinIdentity) Unwrap(Stanza) ([]byte, error) {
+	return nil, fmt.Errorf("%w: PIV device 1234: wrong PIN", ErrPIN)
+}
+
+// countingIdentity records each unwrap attempt
+type countingIdentity struct {
+	Identity
+	calls *int
+}
+
+func (identity countingIdentity) Unwrap(stanza Stanza) ([]byte, error) {
+	*identity.calls++
+	return identity.Identity.Unwrap(stanza)
+}
+
+func TestDecryptWrongPin(t *testing.T) {
+	identities, recipients := generateIdentities(t)
+
+	payload, err := Encrypt(message, recipients...)
+	if err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+
+	// Another device must not be tried with a PIN that was already rejected
+	var calls int
+	var out secrets
+
+	if _, err = Decrypt(payload, &out, wrongPinIdentity{}, countingIdentity{identities[1], &calls}); !errors.Is(err, ErrPIN) {
+		t.Errorf("Decrypt(wrong PIN) error = %v, want %v", err, ErrPIN)
+	}
+
+	if calls > 0 {
+		t.Errorf("Decrypt(wrong PIN) tried %d more identities", calls)
+	}
+}
+
+func TestDecryptTampered(t *testing.T) {
+	identities, recipients := generateIdentities(t)
+
+	payload, err := Encrypt(message, recipients...)
+	if err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+
+	var envelope map[string]any
+	json.Unmarshal(payload, &envelope)
+
+	// Editing an authenticated header field must be detected
+	envelope["rcpt"].([]any)[1].(map[string]any)["dev"] = 12345
+	tampered, _ := json.Marshal(envelope)
+
+	var out secrets
+	var tamper TamperError
+
+	if _, err = Decrypt(tampered, &out, identities[0]); !errors.As(err, &tamper) {
+		t.Errorf("Decrypt(tampered) error = %v, want TamperError", err)
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	recipient, err := ParseRecipient(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	if err != nil {
+		t.Fatalf("ParseRecipient() error = %v", err)
+	}
+
+	// Keys without a serial are software keys
+	if recipient.PIV {
+		t.Errorf("ParseRecipient() PIV = true for a key without a serial")
+	}
+
+	der, _ = x509.MarshalPKCS8PrivateKey(key)
+	identity, err := ParseIdentity(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		t.Fatalf("ParseIdentity() error = %v", err)
+	}
+
+	payload, err := Encrypt(message, recipient)
+	if err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+
+	var out secrets
+	if _, err = Decrypt(payload, &out, identity); err != nil {
+		t.Errorf("Decrypt() error = %v", err)
+	}
+
+	if _, err = ParseIdentity([]byte("not a key")); !errors.Is(err, ErrNoPEMObject) {
+		t.Errorf("ParseIdentity(garbage) error = %v, want %v", err, ErrNoPEMObject)
+	}
+}
+
+func TestEncodeRecipient(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	data, err := EncodeRecipient(KeyRecipient{Device: 1234567, PublicKey: &key.PublicKey}, nil)
+	if err != nil {
+		t.Fatalf("EncodeRecipient() error = %v", err)
+	}
+
+	recipient, err := ParseRecipient(data)
+	if err != nil {
+		t.Fatalf("ParseRecipient() error = %v", err)
+	}
+
+	if recipient.Device != 1234567 || !recipient.PIV || !key.PublicKey.Equal(recipient.PublicKey) {
+		t.Errorf("ParseRecipient() = %d %v, want %d %v", recipient.Device, recipient.PublicKey, 1234567, &key.PublicKey)
+	}
+
+	// OpenSSL rejects PEM headers other than those of encrypted legacy keys
+	if block, _ := pem.Decode(data); block == nil || len(block.Headers) > 0 {
+		t.Errorf("EncodeRecipient() = %q, want a PEM block without headers", data)
+	}
+
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	legacy := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Headers: map[string]string{SerialHeader: "7654321"}, Bytes: der})
+
+	if recipient, err = ParseRecipient(legacy); err != nil || recipient.Device != 7654321 {
+		t.Errorf("ParseRecipient(legacy) = %d, %v, want %d", recipient.Device, err, 7654321)
+	}
+}
+
+func TestLegacyKeyID(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	secret := make([]byte, 32)
+	rand.Read(secret)
+
+	stanza, err := KeyRecipient{PublicKey: &key.PublicKey}.Wrap(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := common.FingerprintSPKI(&key.PublicKey); stanza.KeyID != want {
+		t.Errorf("Wrap() KeyID = %s, want %s", stanza.KeyID, want)
+	}
+
+	// Stanzas written by older releases identify keys by their legacy fingerprint
+	stanza.KeyID = common.FingerprintKey(&key.PublicKey)
+
+	meta, err := EncryptEC(&key.PublicKey, stanza.KeyID, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stanza.Metadata, _ = json.Marshal(meta)
+	if _, err = (KeyIdentity{ECDHKey{key}}).Unwrap(stanza); err != nil {
+		t.Errorf("Unwrap(legacy key ID) error = %v", err)
+	}
+}
+
+func TestPassphrase(t *testing.T) {
+	identities, recipients := generateIdentities(t)
+
+	payload, err := Encrypt(message, recipients[0], PassphraseRecipient{[]byte("correct horse")})
+	if err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+
+	var out secrets
+	if _, err = Decrypt(payload, &out, PassphraseIdentity{[]byte("battery staple")}); !errors.Is(err, ErrNoMatch) {
+		t.Errorf("Decrypt(wrong passphrase) error = %v, want %v", err, ErrNoMatch)
+	}
+
+	if _, err = Decrypt(payload, &out, identities[1], PassphraseIdentity{[]byte("correct horse")}); err != nil || out.RootToken != message.RootToken {
+		t.Errorf("Decrypt(passphrase) = %+v, %v", out, err)
+	}
+}
+
+func TestPassphraseThreshold(t *testing.T) {
+	identities, recipients := generateIdentities(t)
+
+	payload, err := EncryptThreshold(message, 2, append(recipients, PassphraseRecipient{[]byte("correct horse")})...)
+	if err != nil {
+		t.Fatalf("EncryptThreshold() error = %v", err)
+	}
+
+	// The passphrase alone recovers the data-key, without any of the 2-of-3 keys
+	var out secrets
+	if _, err = Decrypt(payload, &out, PassphraseIdentity{[]byte("correct horse")}); err != nil || out.RootToken != message.RootToken {
+		t.Errorf("Decrypt(passphrase) = %+v, %v", out, err)
+	}
+
+	// A single key is still not enough
+	if _, err = Decrypt(payload, &out, identities[0]); !errors.Is(err, ErrNoQuorum) {
+		t.Errorf("Decrypt(one of 2) error = %v, want %v", err, ErrNoQuorum)
+	}
+
+	if _, err = Decrypt(payload, &out, identities[0], identities[2]); err != nil {
+		t.Errorf("Decrypt(two of 2) error = %v", err)
+	}
+}
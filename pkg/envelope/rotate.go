@@ -0,0 +1,63 @@
+package envelope
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jmanero/vault-yubikey-helper/pkg/common"
+	"go.uber.org/zap"
+)
+
+// ErrRecipientNotFound is returned if an envelope has no stanza for a recipient being replaced
+var ErrRecipientNotFound = errors.New("Envelope has no stanza for the recipient being replaced")
+
+// Replace decrypts an envelope, and seals its payload under a new data-key for the recipient in place
+// of the first stanza accepted by the match function, and for the recipients of all other stanzas,
+// returned by the resolve function. Threshold envelopes are split again, so that neither the replaced
+// recipient nor earlier copies of the envelope hold a share of the new data-key. The identities must
+// be able to recover the data-key
+func Replace(payload []byte, match func(Stanza) bool, recipient Recipient, resolve func([]Stanza) ([]Recipient, error), identities ...Identity) (_ []byte, err error) {
+	envelope, err := Parse(payload)
+	if err != nil {
+		return
+	}
+
+	index := -1
+	for i, stanza := range envelope.Recipients {
+		if match(stanza) {
+			index = i
+			break
+		}
+	}
+
+	if index < 0 {
+		return nil, ErrRecipientNotFound
+	}
+
+	data, _, _, err := envelope.open(identities)
+	if err != nil {
+		return
+	}
+
+	others := make([]Stanza, 0, len(envelope.Recipients)-1)
+	others = append(others, envelope.Recipients[:index]...)
+	others = append(others, envelope.Recipients[index+1:]...)
+
+	resolved, err := resolve(others)
+	if err != nil {
+		return
+	}
+
+	if len(resolved) != len(others) {
+		return nil, fmt.Errorf("%w: resolved %d of %d other recipients", ErrRecipientNotFound, len(resolved), len(others))
+	}
+
+	// Keep the order of recipients
+	recipients := make([]Recipient, 0, len(envelope.Recipients))
+	recipients = append(recipients, resolved[:index]...)
+	recipients = append(recipients, recipient)
+	recipients = append(recipients, resolved[index:]...)
+
+	common.Logger.Info("Replacing recipient", zap.Uint32("from", envelope.Recipients[index].Device), zap.String("from_key_id", envelope.Recipients[index].KeyID), zap.Int("t", envelope.Threshold), zap.Int("n", len(recipients)))
+	return Seal(data, envelope.Threshold, recipients...)
+}
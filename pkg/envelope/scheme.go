@@ -0,0 +1,126 @@
+package envelope
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Envelope format versions
+const (
+	// VersionLegacy envelopes have no version or algorithm identifiers
+	VersionLegacy = 0
+
+	// VersionAlgorithms envelopes record algorithm identifiers for their cipher and recipient stanzas
+	VersionAlgorithms = 1
+
+	// VersionAuthenticated envelopes bind their header fields into the cipher's additional data
+	VersionAuthenticated = 2
+
+	// Version of envelopes written by Encrypt
+	Version = VersionAuthenticated
+)
+
+// Algorithm identifiers
+const (
+	// AlgorithmAESGCM encrypts payloads with AES-256 in GCM mode
+	AlgorithmAESGCM = "A256GCM"
+
+	// SchemeECDH wraps data-keys with a secret derived from an ephemeral ECDH key-agreement
+	SchemeECDH = "ECDH-ES"
+
+	// SchemeRSA wraps data-keys with RSA encryption
+	SchemeRSA = "RSA"
+
+	// SchemeScrypt wraps data-keys with a key derived from a passphrase
+	SchemeScrypt = "scrypt"
+)
+
+// Errors
+var (
+	ErrUnsupportedVersion   = errors.New("Unsupported envelope version")
+	ErrUnsupportedAlgorithm = errors.New("Unsupported algorithm")
+)
+
+// Scheme wraps data-keys with a type of public-key, and unwraps them with the matching private key
+type Scheme struct {
+	Wrap   func(recipient KeyRecipient, kid string, secret []byte) (meta any, err error)
+	Unwrap func(key crypto.Decrypter, stanza Stanza) (secret []byte, err error)
+}
+
+// Schemes registers supported key-wrapping schemes by their algorithm identifiers
+var Schemes = map[string]Scheme{
+	SchemeECDH: {
+		Wrap: func(recipient KeyRecipient, kid string, secret []byte) (any, error) {
+			return EncryptEC(recipient.PublicKey.(*ecdsa.PublicKey), kid, secret)
+		},
+		Unwrap: DecryptEC,
+	},
+	SchemeRSA: {
+		Wrap: func(recipient KeyRecipient, _ string, secret []byte) (any, error) {
+			// PIV devices always remove PKCS1v15 padding from RSA decryption, and can not unwrap RSA-OAEP
+			if recipient.PIV {
+				return EncryptRSA(recipient.PublicKey.(*rsa.PublicKey), RSAPKCS1v15, secret)
+			}
+
+			return EncryptRSA(recipient.PublicKey.(*rsa.PublicKey), RSAOAEP256, secret)
+		},
+		Unwrap: DecryptRSA,
+	},
+}
+
+// SchemeFor returns the identifier of the key-wrapping scheme for a type of public-key
+func SchemeFor(pub crypto.PublicKey) (string, error) {
+	switch pub.(type) {
+	case *ecdsa.PublicKey:
+		return SchemeECDH, nil
+	case *rsa.PublicKey:
+		return SchemeRSA, nil
+	default:
+		return "", fmt.Errorf("%w: %T", ErrUnsupportedKey, pub)
+	}
+}
+
+// GetScheme looks up a registered key-wrapping scheme
+func GetScheme(alg string) (Scheme, error) {
+	scheme, has := Schemes[alg]
+	if !has {
+		return scheme, fmt.Errorf("%w: %q", ErrUnsupportedAlgorithm, alg)
+	}
+
+	return scheme, nil
+}
+
+// header contains the envelope fields that are authenticated by the cipher
+type header struct {
+	Version    int      `json:"v"`
+	Algorithm  string   `json:"alg"`
+	Threshold  int      `json:"t,omitempty"`
+	Recipients []Stanza `json:"rcpt"`
+}
+
+// AdditionalData encodes header fields for authentication by the cipher. Envelopes
+// older than VersionAuthenticated have no additional data
+func AdditionalData(version int, alg string, threshold int, recipients []Stanza) ([]byte, error) {
+	if version < VersionAuthenticated {
+		return nil, nil
+	}
+
+	return json.Marshal(header{Version: version, Algorithm: alg, Threshold: threshold, Recipients: recipients})
+}
+
+// legacyScheme infers the key-wrapping scheme of an unversioned stanza from the format of its KeyID
+func legacyScheme(kid string) string {
+	switch {
+	case strings.HasPrefix(kid, "EC:"):
+		return SchemeECDH
+	case strings.HasPrefix(kid, "RSA:"):
+		return SchemeRSA
+	default:
+		return ""
+	}
+}
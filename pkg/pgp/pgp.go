@@ -0,0 +1,81 @@
+package pgp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+)
+
+// ErrNoKeys is returned if a key file contains no OpenPGP public keys
+var ErrNoKeys = errors.New("No OpenPGP public keys found")
+
+// ParseKeys reads OpenPGP public keys in armored, binary, or base64 encoded binary form. The
+// latter is accepted by the -pgp-keys flag of `vault operator init`
+func ParseKeys(data []byte) (keys openpgp.EntityList, err error) {
+	data = bytes.TrimSpace(data)
+
+	switch {
+	case bytes.HasPrefix(data, []byte("-----BEGIN")):
+		keys, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+
+	default:
+		if decoded, err1 := base64.StdEncoding.DecodeString(string(data)); err1 == nil {
+			data = decoded
+		}
+
+		keys, err = openpgp.ReadKeyRing(bytes.NewReader(data))
+	}
+
+	if err != nil {
+		return
+	}
+
+	if len(keys) == 0 {
+		return nil, ErrNoKeys
+	}
+
+	return
+}
+
+// Encrypt data for all of the given keys, returning an armored OpenPGP message that can be
+// decrypted by any one of them, e.g. with `gpg --decrypt`
+func Encrypt(data []byte, keys openpgp.EntityList) (_ []byte, err error) {
+	if len(keys) == 0 {
+		return nil, ErrNoKeys
+	}
+
+	var buffer bytes.Buffer
+
+	armored, err := armor.Encode(&buffer, "PGP MESSAGE", nil)
+	if err != nil {
+		return
+	}
+
+	plain, err := openpgp.Encrypt(armored, keys, nil, &openpgp.FileHints{IsBinary: true}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("OpenPGP encryption failed: %w", err)
+	}
+
+	_, err = io.Copy(plain, bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+
+	err = plain.Close()
+	if err != nil {
+		return
+	}
+
+	err = armored.Close()
+	if err != nil {
+		return
+	}
+
+	buffer.WriteByte('\n')
+	return buffer.Bytes(), nil
+}
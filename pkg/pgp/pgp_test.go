@@ -0,0 +1,97 @@
+package pgp
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/base64"
+	"io"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// config sets hash preferences on test keys, like those generated by gpg
+var config = &packet.Config{DefaultHash: crypto.SHA256}
+
+func TestEncrypt(t *testing.T) {
+	first, err := openpgp.NewEntity("first", "", "first@example.com", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := openpgp.NewEntity("second", "", "second@example.com", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys are accepted in the base64 format of `vault operator init -pgp-keys`
+	var public bytes.Buffer
+	first.SerializePrivate(io.Discard, config) // Signs self-signatures
+	first.Serialize(&public)
+
+	keys, err := ParseKeys([]byte(base64.StdEncoding.EncodeToString(public.Bytes())))
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("ParseKeys(base64) = %d keys, %v", len(keys), err)
+	}
+
+	message, err := Encrypt([]byte("secret"), append(keys, second))
+	if err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+
+	for _, entity := range []*openpgp.Entity{first, second} {
+		block, err := armor.Decode(bytes.NewReader(message))
+		if err != nil {
+			t.Fatalf("armor.Decode() error = %v", err)
+		}
+
+		details, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{entity}, nil, nil)
+		if err != nil {
+			t.Fatalf("ReadMessage(%s) error = %v", entity.PrimaryKey.KeyIdShortString(), err)
+		}
+
+		out, _ := io.ReadAll(details.UnverifiedBody)
+		if string(out) != "secret" {
+			t.Errorf("ReadMessage(%s) = %q", entity.PrimaryKey.KeyIdShortString(), out)
+		}
+	}
+}
+
+// GnuPG generates ed25519 keys with cv25519 encryption subkeys by default
+func TestEncryptECC(t *testing.T) {
+	entity, err := openpgp.NewEntity("ecc", "", "ecc@example.com", &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA, Curve: packet.Curve25519})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var public bytes.Buffer
+	writer, _ := armor.Encode(&public, openpgp.PublicKeyType, nil)
+	entity.Serialize(writer)
+	writer.Close()
+
+	keys, err := ParseKeys(public.Bytes())
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("ParseKeys(armored) = %d keys, %v", len(keys), err)
+	}
+
+	message, err := Encrypt([]byte("secret"), keys)
+	if err != nil {
+		t.Fatalf("Encrypt(cv25519) error = %v", err)
+	}
+
+	block, err := armor.Decode(bytes.NewReader(message))
+	if err != nil {
+		t.Fatalf("armor.Decode() error = %v", err)
+	}
+
+	details, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{entity}, nil, nil)
+	if err != nil {
+		t.Fatalf("ReadMessage(cv25519) error = %v", err)
+	}
+
+	if out, _ := io.ReadAll(details.UnverifiedBody); string(out) != "secret" {
+		t.Errorf("ReadMessage(cv25519) = %q", out)
+	}
+}
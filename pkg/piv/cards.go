@@ -18,6 +18,7 @@ import (
 // Errors
 var (
 	ErrNoCards   = errors.New("No PIV devices detected")
+	ErrNoMatch   = errors.New("None of the attached PIV devices match")
 	ErrInvalidID = errors.New("Invalid device identifier")
 )
 
@@ -121,6 +122,8 @@ func TryCard(name string, opts Options) (info CardInfo, token *ykpiv.Yubikey, er
 		return
 	}
 
+	info.Name = name
+
 	// Ensure that token is closed if an error is returned
 	defer func() {
 		if err != nil {
@@ -173,7 +176,7 @@ func Open(opts Options) (token *ykpiv.Yubikey, err error) {
 	// Scan devices for a matching serial number
 	for _, name := range devices {
 		info, token, err1 = TryCard(name, opts)
-		if err != nil {
+		if err1 != nil {
 			common.Logger.Warn("Unable to open PIV device", zap.Uint32("serial", info.Serial), zap.String("version", string(info.Version)), zap.Error(err1))
 			continue
 		}
@@ -199,6 +202,45 @@ func Open(opts Options) (token *ykpiv.Yubikey, err error) {
 	return nil, fmt.Errorf("%w: Unable to use any of the attached PIV devices. Please ensure that a device with the given serial number is attached or provision the KEY_MANAGEMENT slot of at least one attached device to auto-select", ErrNoCards)
 }
 
+// Match opens the first attached PIV device that is accepted by the match function, regardless of
+// the Serial and Avoid options. The returned error reports each device that was tried and rejected
+func Match(opts Options, match func(CardInfo) error) (token *ykpiv.Yubikey, info CardInfo, err error) {
+	devices, err := ykpiv.Readers()
+	if err != nil {
+		return
+	}
+
+	if len(devices) == 0 {
+		return nil, info, ErrNoCards
+	}
+
+	var errs error
+	for _, name := range devices {
+		var err1 error
+
+		info, token, err1 = TryCard(name, opts)
+		if err1 != nil {
+			common.Logger.Warn("Unable to open PIV device", zap.String("reader", name), zap.Error(err1))
+			errs = multierr.Append(errs, fmt.Errorf("%s: %w", name, err1))
+			continue
+		}
+
+		err1 = match(info)
+		if err1 != nil {
+			common.Logger.Info("Skipping PIV device", zap.String("reader", name), zap.Uint32("serial", info.Serial), zap.Error(err1))
+			errs = multierr.Append(errs, fmt.Errorf("%s (serial %d): %w", name, info.Serial, err1))
+
+			token.Close()
+			continue
+		}
+
+		common.Logger.Info("Using matching PIV device", zap.String("reader", name), zap.Uint32("serial", info.Serial), zap.String("version", string(info.Version)), zap.Bool("pin", opts.GetPin() != nil))
+		return token, info, nil
+	}
+
+	return nil, CardInfo{}, multierr.Append(fmt.Errorf("%w: tried %d devices", ErrNoMatch, len(devices)), errs)
+}
+
 // Scan attempts to list all available PIV devices and indicate which device would be selected by default
 func Scan(opts Options) (cards []CardInfo, selected bool, err error) {
 	devices, err := ykpiv.Readers()
@@ -233,7 +275,37 @@ func Scan(opts Options) (cards []CardInfo, selected bool, err error) {
 	return
 }
 
+// Select auto-selects the given number of distinct PIV devices that are not avoided, returning Options to open each of them by serial
+func Select(opts Options, count int) (selected []Options, err error) {
+	cards, _, err := Scan(opts)
+	if err != nil {
+		common.Logger.Warn("Unable to open some PIV devices", zap.Error(err))
+	}
+
+	for _, card := range cards {
+		if len(selected) == count {
+			break
+		}
+
+		if opts.Exclude(card.Serial) {
+			continue
+		}
+
+		common.Logger.Info("Using auto-selected PIV device", zap.Uint32("serial", card.Serial), zap.String("version", string(card.Version)))
+
+		choice := opts.Copy()
+		choice.Serial = card.Serial
+		selected = append(selected, choice)
+	}
+
+	if len(selected) < count {
+		return nil, fmt.Errorf("%w: Found %d of %d required PIV devices. Please attach more devices or adjust --avoid-serial flags", ErrNoCards, len(selected), count)
+	}
+
+	return selected, nil
+}
+
 func (card CardInfo) String() string {
-	return fmt.Sprintf("%s\n\tversion: %s\n\tserial:  %d\n\tselected: %t\n\tpubkey:  %v",
-		card.Name, string(card.Version), card.Serial, card.Selected, common.FingerprintKey(card.PublicKey))
+	return fmt.Sprintf("%s\n\tversion: %s\n\tserial:  %d\n\tselected: %t\n\tpubkey:  %v\n\tlegacy:  %v",
+		card.Name, string(card.Version), card.Serial, card.Selected, common.FingerprintSPKI(card.PublicKey), common.FingerprintKey(card.PublicKey))
 }
@@ -0,0 +1,126 @@
+package shamir
+
+import (
+	"crypto/rand"
+	"errors"
+)
+
+// Errors
+var (
+	ErrParts          = errors.New("Number of parts must be between 2 and 255")
+	ErrThreshold      = errors.New("Threshold must be between 2 and the number of parts")
+	ErrEmptySecret    = errors.New("Unable to split an empty secret")
+	ErrShareLength    = errors.New("All shares must have the same length of at least two bytes")
+	ErrDuplicateShare = errors.New("Shares must have unique x-coordinates")
+)
+
+// mul multiplies two elements of GF(2^8) without branching on their values
+func mul(a, b uint8) (out uint8) {
+	for i := 0; i < 8; i++ {
+		out ^= a & -(b & 1)
+		a = a<<1 ^ 0x1b&-(a>>7)
+		b >>= 1
+	}
+
+	return
+}
+
+// inv computes the multiplicative inverse of an element of GF(2^8) as a^254
+func inv(a uint8) (out uint8) {
+	out = a
+	for i := 0; i < 6; i++ {
+		out = mul(mul(out, out), a)
+	}
+
+	return mul(out, out)
+}
+
+// Split divides a secret into the given number of parts, any threshold of
+// which can be combined to recover it. Each part is one byte longer than the
+// secret, with its x-coordinate stored in the trailing byte.
+func Split(secret []byte, parts, threshold int) ([][]byte, error) {
+	switch {
+	case parts < 2 || parts > 255:
+		return nil, ErrParts
+	case threshold < 2 || threshold > parts:
+		return nil, ErrThreshold
+	case len(secret) == 0:
+		return nil, ErrEmptySecret
+	}
+
+	shares := make([][]byte, parts)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][len(secret)] = uint8(i + 1)
+	}
+
+	coefficients := make([]byte, threshold)
+	for b, value := range secret {
+		// Generate a random polynomial of degree threshold-1 with the secret byte as its intercept
+		_, err := rand.Read(coefficients[1:])
+		if err != nil {
+			return nil, err
+		}
+
+		coefficients[0] = value
+
+		for _, share := range shares {
+			x := share[len(secret)]
+
+			// Evaluate the polynomial at x with Horner's method
+			var y uint8
+			for c := threshold - 1; c >= 0; c-- {
+				y = mul(y, x) ^ coefficients[c]
+			}
+
+			share[b] = y
+		}
+	}
+
+	return shares, nil
+}
+
+// Combine recovers a secret from a threshold of parts generated by Split
+func Combine(parts [][]byte) ([]byte, error) {
+	if len(parts) < 2 {
+		return nil, ErrThreshold
+	}
+
+	size := len(parts[0])
+	if size < 2 {
+		return nil, ErrShareLength
+	}
+
+	xs := make([]uint8, len(parts))
+	seen := make(map[uint8]struct{}, len(parts))
+
+	for i, part := range parts {
+		if len(part) != size {
+			return nil, ErrShareLength
+		}
+
+		xs[i] = part[size-1]
+		if _, has := seen[xs[i]]; has || xs[i] == 0 {
+			return nil, ErrDuplicateShare
+		}
+
+		seen[xs[i]] = struct{}{}
+	}
+
+	secret := make([]byte, size-1)
+	for i, part := range parts {
+		// Lagrange basis polynomial for part i, evaluated at x = 0
+		basis := uint8(1)
+		for j := range parts {
+			if i != j {
+				basis = mul(basis, mul(xs[j], inv(xs[j]^xs[i])))
+			}
+		}
+
+		for b := range secret {
+			secret[b] ^= mul(part[b], basis)
+		}
+	}
+
+	return secret, nil
+}
@@ -0,0 +1,83 @@
+package shamir
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestInverse(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if out := mul(uint8(a), inv(uint8(a))); out != 1 {
+			t.Errorf("mul(%#x, inv(%#x)) = %#x, want 1", a, a, out)
+		}
+	}
+}
+
+var splitTests = []struct {
+	parts     int
+	threshold int
+}{
+	{2, 2},
+	{3, 2},
+	{5, 3},
+	{10, 10},
+	{255, 7},
+}
+
+func TestSplitCombine(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+
+	for _, tt := range splitTests {
+		shares, err := Split(secret, tt.parts, tt.threshold)
+		if err != nil {
+			t.Fatalf("Split(%d, %d) error = %v", tt.parts, tt.threshold, err)
+		}
+
+		// Any window of threshold shares recovers the secret
+		for i := 0; i+tt.threshold <= tt.parts; i++ {
+			out, err := Combine(shares[i : i+tt.threshold])
+			if err != nil {
+				t.Errorf("Combine(%d-of-%d, offset %d) error = %v", tt.threshold, tt.parts, i, err)
+			} else if !bytes.Equal(out, secret) {
+				t.Errorf("Combine(%d-of-%d, offset %d) = %x, want %x", tt.threshold, tt.parts, i, out, secret)
+			}
+		}
+
+		// Fewer than threshold shares must not recover the secret
+		if tt.threshold > 2 {
+			out, err := Combine(shares[:tt.threshold-1])
+			if err == nil && bytes.Equal(out, secret) {
+				t.Errorf("Combine(%d-of-%d) recovered the secret with %d shares", tt.threshold, tt.parts, tt.threshold-1)
+			}
+		}
+	}
+}
+
+func TestSplitInvalid(t *testing.T) {
+	if _, err := Split([]byte("secret"), 1, 1); err != ErrParts {
+		t.Errorf("Split(1, 1) error = %v, want %v", err, ErrParts)
+	}
+
+	if _, err := Split([]byte("secret"), 3, 4); err != ErrThreshold {
+		t.Errorf("Split(3, 4) error = %v, want %v", err, ErrThreshold)
+	}
+
+	if _, err := Split(nil, 3, 2); err != ErrEmptySecret {
+		t.Errorf("Split(nil) error = %v, want %v", err, ErrEmptySecret)
+	}
+}
+
+func TestCombineInvalid(t *testing.T) {
+	shares, err := Split([]byte("secret"), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Combine([][]byte{shares[0], shares[0]}); err != ErrDuplicateShare {
+		t.Errorf("Combine(duplicate) error = %v, want %v", err, ErrDuplicateShare)
+	}
+
+	if _, err := Combine([][]byte{shares[0], shares[1][1:]}); err != ErrShareLength {
+		t.Errorf("Combine(truncated) error = %v, want %v", err, ErrShareLength)
+	}
+}
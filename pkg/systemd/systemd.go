@@ -0,0 +1,62 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Notification states
+const (
+	Ready    = "READY=1"
+	Stopping = "STOPPING=1"
+)
+
+// Status formats a free-form status notification
+func Status(status string) string {
+	return "STATUS=" + status
+}
+
+// Notify sends states to the service manager's notification socket. It does nothing if the
+// process was not started by systemd with $NOTIFY_SOCKET, e.g. for Type=notify units
+func Notify(states ...string) (err error) {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if len(name) == 0 {
+		return
+	}
+
+	// Abstract namespace sockets are given with a leading @
+	if name[0] == '@' {
+		name = "\x00" + name[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(strings.Join(states, "\n")))
+	return
+}
+
+// Credential reads a credential passed to the service with LoadCredential= or SetCredential=. It
+// returns false if the process was not given a $CREDENTIALS_DIRECTORY or the credential does not exist
+func Credential(name string) (value []byte, has bool, err error) {
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if len(dir) == 0 {
+		return
+	}
+
+	value, err = os.ReadFile(filepath.Join(dir, name))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+
+	if err != nil {
+		return
+	}
+
+	return value, true, nil
+}
@@ -0,0 +1,48 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNotify(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "notify.sock")
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	t.Setenv("NOTIFY_SOCKET", name)
+	if err = Notify(Ready, Status("Unsealed")); err != nil {
+		t.Fatalf("Notify() error = %v", err)
+	}
+
+	buffer := make([]byte, 64)
+	n, _, err := conn.ReadFrom(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := string(buffer[:n]); got != "READY=1\nSTATUS=Unsealed" {
+		t.Errorf("Notify() sent %q", got)
+	}
+}
+
+func TestCredential(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "yubikey-pin"), []byte("deadbeef"), 0600)
+
+	t.Setenv("CREDENTIALS_DIRECTORY", dir)
+
+	if value, has, err := Credential("yubikey-pin"); err != nil || !has || string(value) != "deadbeef" {
+		t.Errorf("Credential(yubikey-pin) = %q, %t, %v", value, has, err)
+	}
+
+	if _, has, err := Credential("missing"); err != nil || has {
+		t.Errorf("Credential(missing) = %t, %v", has, err)
+	}
+}
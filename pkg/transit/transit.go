@@ -0,0 +1,204 @@
+package transit
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/jmanero/vault-yubikey-helper/pkg/common"
+	"github.com/jmanero/vault-yubikey-helper/pkg/envelope"
+	"go.uber.org/zap"
+)
+
+// CiphertextPrefix marks ciphertexts in the format of Vault's Transit secrets engine. Key versions are
+// not supported, as the data-key of each envelope is wrapped for the server's recipients
+const CiphertextPrefix = "vault:v1:"
+
+// Errors
+var (
+	ErrCiphertext  = errors.New("Invalid ciphertext")
+	ErrUnknownKey  = errors.New("Unknown encryption key")
+	ErrPermission  = errors.New("Permission denied")
+	ErrInvalidBody = errors.New("Invalid request body")
+)
+
+// Server implements the subset of Vault's Transit secrets engine API used by Vault's transit seal. Data
+// is encrypted into envelopes for Recipients, and decrypted with Identities
+type Server struct {
+	Mount string
+	Key   string
+	Token string
+
+	Threshold  int
+	Recipients []envelope.Recipient
+	Identities []envelope.Identity
+
+	// PIV devices handle one operation at a time
+	mu sync.Mutex
+}
+
+// Encrypt seals plaintext into an envelope, formatted as a transit ciphertext
+func (server *Server) Encrypt(plaintext []byte) (ciphertext string, err error) {
+	payload, err := envelope.Seal(plaintext, server.Threshold, server.Recipients...)
+	if err != nil {
+		return
+	}
+
+	return CiphertextPrefix + base64.StdEncoding.EncodeToString(payload), nil
+}
+
+// Decrypt opens an envelope from a transit ciphertext
+func (server *Server) Decrypt(ciphertext string) (plaintext []byte, err error) {
+	encoded, has := strings.CutPrefix(ciphertext, CiphertextPrefix)
+	if !has {
+		return nil, fmt.Errorf("%w: expected prefix %s", ErrCiphertext, CiphertextPrefix)
+	}
+
+	payload, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCiphertext, err)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	plaintext, _, err = envelope.Open(payload, server.Identities...)
+	return
+}
+
+// Handler routes transit API requests
+func (server *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/auth/token/lookup-self", server.lookupSelf)
+	mux.HandleFunc("/v1/"+server.Mount+"/encrypt/", server.encrypt)
+	mux.HandleFunc("/v1/"+server.Mount+"/decrypt/", server.decrypt)
+
+	return server.authorize(mux)
+}
+
+// response is the envelope of Vault API responses
+type response struct {
+	Data   any      `json:"data,omitempty"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+// reply writes a Vault API response
+func reply(w http.ResponseWriter, status int, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	json.NewEncoder(w).Encode(response{Data: data})
+}
+
+// fail writes a Vault API error response
+func fail(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	json.NewEncoder(w).Encode(response{Errors: []string{err.Error()}})
+}
+
+// authorize checks the X-Vault-Token header of each request
+func (server *Server) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get("X-Vault-Token")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(server.Token)) != 1 {
+			common.Logger.Warn("Rejecting transit request with invalid token", zap.String("path", r.URL.Path), zap.String("remote", r.RemoteAddr))
+			fail(w, http.StatusForbidden, ErrPermission)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// lookupSelf describes the server's token. It is not renewable, so Vault does not try to renew it
+func (server *Server) lookupSelf(w http.ResponseWriter, r *http.Request) {
+	reply(w, http.StatusOK, map[string]any{
+		"display_name": "transit",
+		"policies":     []string{"transit"},
+		"renewable":    false,
+		"ttl":          0,
+		"type":         "service",
+	})
+}
+
+// request decodes a POST request body for the server's key
+func (server *Server) request(w http.ResponseWriter, r *http.Request, action string, body any) bool {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		fail(w, http.StatusMethodNotAllowed, fmt.Errorf("%w: unsupported method %s", ErrInvalidBody, r.Method))
+		return false
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, "/v1/"+server.Mount+"/"+action+"/")
+	if key != server.Key {
+		fail(w, http.StatusBadRequest, fmt.Errorf("%w: %s", ErrUnknownKey, key))
+		return false
+	}
+
+	err := json.NewDecoder(r.Body).Decode(body)
+	if err != nil {
+		fail(w, http.StatusBadRequest, fmt.Errorf("%w: %w", ErrInvalidBody, err))
+		return false
+	}
+
+	return true
+}
+
+// encrypt handles transit encrypt requests
+func (server *Server) encrypt(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Plaintext string `json:"plaintext"`
+	}
+
+	if !server.request(w, r, "encrypt", &body) {
+		return
+	}
+
+	plaintext, err := base64.StdEncoding.DecodeString(body.Plaintext)
+	if err != nil {
+		fail(w, http.StatusBadRequest, fmt.Errorf("%w: plaintext must be base64 encoded: %w", ErrInvalidBody, err))
+		return
+	}
+
+	ciphertext, err := server.Encrypt(plaintext)
+	if err != nil {
+		common.Logger.Error("Unable to encrypt transit request", zap.Error(err))
+		fail(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	common.Logger.Info("Encrypted transit request", zap.String("key", server.Key), zap.String("remote", r.RemoteAddr))
+	reply(w, http.StatusOK, map[string]any{"ciphertext": ciphertext, "key_version": 1})
+}
+
+// decrypt handles transit decrypt requests
+func (server *Server) decrypt(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Ciphertext string `json:"ciphertext"`
+	}
+
+	if !server.request(w, r, "decrypt", &body) {
+		return
+	}
+
+	plaintext, err := server.Decrypt(body.Ciphertext)
+	if errors.Is(err, ErrCiphertext) {
+		fail(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err != nil {
+		common.Logger.Error("Unable to decrypt transit request", zap.Error(err))
+		fail(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	common.Logger.Info("Decrypted transit request", zap.String("key", server.Key), zap.String("remote", r.RemoteAddr))
+	reply(w, http.StatusOK, map[string]any{"plaintext": base64.StdEncoding.EncodeToString(plaintext)})
+}
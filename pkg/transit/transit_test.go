@@ -0,0 +1,79 @@
+package transit
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hashicorp/vault/api"
+	"github.com/jmanero/vault-yubikey-helper/pkg/envelope"
+)
+
+func TestServer(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	server := &Server{
+		Mount:      "transit",
+		Key:        "autounseal",
+		Token:      "transit-token",
+		Recipients: []envelope.Recipient{envelope.KeyRecipient{PublicKey: &key.PublicKey}},
+		Identities: []envelope.Identity{envelope.KeyIdentity{Key: envelope.ECDHKey{PrivateKey: key}}},
+	}
+
+	listener := httptest.NewServer(server.Handler())
+	defer listener.Close()
+
+	config := api.DefaultConfig()
+	config.Address = listener.URL
+
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.SetToken("transit-token")
+
+	// Calls made by Vault's transit seal
+	self, err := client.Auth().Token().LookupSelf()
+	if err != nil {
+		t.Fatalf("LookupSelf() error = %v", err)
+	}
+
+	if renewable, _ := self.TokenIsRenewable(); renewable {
+		t.Errorf("LookupSelf() token is renewable")
+	}
+
+	encrypted, err := client.Logical().Write("transit/encrypt/autounseal", map[string]any{
+		"plaintext": base64.StdEncoding.EncodeToString([]byte("root-key")),
+	})
+
+	if err != nil {
+		t.Fatalf("encrypt error = %v", err)
+	}
+
+	decrypted, err := client.Logical().Write("transit/decrypt/autounseal", map[string]any{
+		"ciphertext": encrypted.Data["ciphertext"],
+	})
+
+	if err != nil {
+		t.Fatalf("decrypt error = %v", err)
+	}
+
+	if plaintext, _ := base64.StdEncoding.DecodeString(decrypted.Data["plaintext"].(string)); string(plaintext) != "root-key" {
+		t.Errorf("decrypt plaintext = %q", plaintext)
+	}
+
+	_, err = client.Logical().Write("transit/encrypt/other", map[string]any{"plaintext": ""})
+	if err == nil {
+		t.Errorf("encrypt with unknown key succeeded")
+	}
+
+	client.SetToken("invalid")
+	_, err = client.Logical().Write("transit/decrypt/autounseal", map[string]any{"ciphertext": encrypted.Data["ciphertext"]})
+	if err == nil {
+		t.Errorf("decrypt with invalid token succeeded")
+	}
+}